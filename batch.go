@@ -0,0 +1,149 @@
+package yarpc
+
+import (
+	"context"
+	"sync"
+	"yarpc/codec"
+)
+
+// 批量调用
+// Client.CallBatch 把多个调用一起编码，一次放入写队列，随后一起刷新到连接上（见 codec.BatchCodec），
+// 上百个小调用只需要一次写操作，而不是每个调用各自编码、各自刷新。
+// 批量中的每个调用仍是独立的请求，有各自的 Seq，服务端逐个读出后为每个调用启动协程并发处理，
+// 各自受并发限制和超时的约束，响应按完成的先后返回，服务端的响应同样在写队列中合并刷新。
+// 设置了客户端拦截器时，每个调用在各自的协程中经过拦截器链，到达最内层 invoker 的调用被收集起来，
+// 等所有调用都到达 invoker（或被拦截器直接返回）后再一起写入；拦截器重试时再次发送的调用单独写入。
+
+// CallBatch sends calls at once and waits for all of them to complete.
+// Each call is prepared with ServiceMethod, Args and Reply, its Done is set by CallBatch,
+// its result is set in Reply, Error, ServerID and Trailer like Go.
+// ctx's deadline and metadata apply to every call, calls not completed when ctx ends are cancelled.
+// Option.Interceptors run for each call, the calls are written once all of them reach the invoker.
+// It returns the error of the first failed call, nil if all of them succeed.
+func (client *Client) CallBatch(ctx context.Context, calls []*Call) error {
+	if len(client.opt.Interceptors) > 0 {
+		return client.interceptBatch(ctx, calls)
+	}
+	deadline, _ := ctx.Deadline()
+	meta, _ := FromOutgoingContext(ctx)
+	for _, call := range calls {
+		call.Done = make(chan *Call, 1)
+		call.deadline, call.meta = deadline, meta
+	}
+	client.sendBatch(calls)
+	var err error
+	for _, call := range calls {
+		if e := client.waitBatched(ctx, call); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// interceptBatch runs the interceptors of each call in its own goroutine,
+// the calls reaching the invoker are collected and sent at once.
+func (client *Client) interceptBatch(ctx context.Context, calls []*Call) error {
+	arrived := make(chan *Call, len(calls)) // nil if the call is returned by interceptors without invoking
+	sent := make(chan struct{})             // closed once the batch is sent
+	var wg sync.WaitGroup
+	for _, call := range calls {
+		call.Done = make(chan *Call, 1)
+		wg.Add(1)
+		go func(call *Call) {
+			defer wg.Done()
+			batched := false
+			var invoker UnaryInvoker = func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+				if batched {
+					// invoked again by a retrying interceptor, the batch may have been sent
+					_, err := client.invoke(ctx, serviceMethod, args, reply)
+					return err
+				}
+				batched = true
+				call.ServiceMethod, call.Args, call.Reply = serviceMethod, args, reply
+				call.deadline, _ = ctx.Deadline()
+				call.meta, _ = FromOutgoingContext(ctx)
+				arrived <- call
+				<-sent
+				return client.waitBatched(ctx, call)
+			}
+			invoker = chainUnaryClient(client.opt.Interceptors, client, invoker)
+			err := invoker(ctx, call.ServiceMethod, call.Args, call.Reply)
+			if !batched {
+				arrived <- nil
+			}
+			call.Error = err
+		}(call)
+	}
+	batch := make([]*Call, 0, len(calls))
+	for range calls {
+		if call := <-arrived; call != nil {
+			batch = append(batch, call)
+		}
+	}
+	client.sendBatch(batch)
+	close(sent)
+	wg.Wait()
+	for _, call := range calls {
+		if call.Error != nil {
+			return call.Error
+		}
+	}
+	return nil
+}
+
+// sendBatch registers calls and writes them at once, calls failed to send are done with the error
+func (client *Client) sendBatch(calls []*Call) {
+	hs := make([]*codec.Header, 0, len(calls))
+	bodies := make([]interface{}, 0, len(calls))
+	sent := make([]*Call, 0, len(calls))
+	for _, call := range calls {
+		if _, err := client.registerCall(call); err != nil {
+			call.Error = err
+			call.done()
+			continue
+		}
+		hs = append(hs, requestHeader(call))
+		bodies = append(bodies, call.Args)
+		sent = append(sent, call)
+	}
+	if len(sent) == 0 {
+		return
+	}
+	if err := client.writeBatch(hs, bodies); err != nil {
+		for _, call := range sent {
+			// call may have been completed by terminateCalls or its response
+			if client.removeCall(call.Seq) != nil {
+				call.Error = err
+				call.done()
+			}
+		}
+	}
+}
+
+// waitBatched waits for the call sent by sendBatch, it's cancelled if ctx ends first
+func (client *Client) waitBatched(ctx context.Context, call *Call) error {
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		if client.removeCall(call.Seq) != nil {
+			client.sendCancel(call.Seq)
+			call.Error = contextError(ctx)
+			call.done()
+		}
+		<-call.Done
+	}
+	return call.Error
+}
+
+// writeBatch writes requests with one flush if the codec supports it
+func (client *Client) writeBatch(hs []*codec.Header, bodies []interface{}) error {
+	if bc, ok := client.cc.(codec.BatchCodec); ok {
+		return bc.WriteBatch(hs, bodies)
+	}
+	for i, h := range hs {
+		if err := client.cc.Write(h, bodies[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
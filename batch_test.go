@@ -0,0 +1,103 @@
+package yarpc
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_CallBatch(t *testing.T) {
+	server := NewServer(0)
+	_ = server.Register(new(Foo))
+	_ = server.Register(new(Slow))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer func() { _ = client.Close() }()
+
+	t.Run("results", func(t *testing.T) {
+		calls := make([]*Call, 100)
+		replies := make([]int, len(calls))
+		for i := range calls {
+			calls[i] = &Call{ServiceMethod: "Foo.Sum", Args: Args{Num1: i, Num2: i}, Reply: &replies[i]}
+		}
+		calls[1].ServiceMethod = "Foo.Unknown"
+		err := client.CallBatch(context.Background(), calls)
+		assert.Equal(t, NotFound, ErrorCode(err), "the first error should be returned")
+		for i, call := range calls {
+			if i == 1 {
+				assert.Equal(t, NotFound, ErrorCode(call.Error))
+				continue
+			}
+			assert.Nil(t, call.Error)
+			assert.Equal(t, 2*i, replies[i])
+		}
+	})
+	t.Run("concurrent", func(t *testing.T) {
+		calls := make([]*Call, 10)
+		replies := make([]int, len(calls))
+		for i := range calls {
+			calls[i] = &Call{ServiceMethod: "Slow.Sleep", Args: 100 * time.Millisecond, Reply: &replies[i]}
+		}
+		start := time.Now()
+		assert.Nil(t, client.CallBatch(context.Background(), calls))
+		assert.Less(t, int64(time.Since(start)), int64(500*time.Millisecond), "calls should be handled concurrently")
+	})
+	t.Run("timeout", func(t *testing.T) {
+		calls := []*Call{
+			{ServiceMethod: "Foo.Sum", Args: Args{Num1: 1, Num2: 2}, Reply: new(int)},
+			{ServiceMethod: "Slow.Sleep", Args: time.Second, Reply: new(int)},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, DeadlineExceeded, ErrorCode(client.CallBatch(ctx, calls)))
+		assert.Nil(t, calls[0].Error)
+		assert.Equal(t, DeadlineExceeded, ErrorCode(calls[1].Error))
+		client.mu.Lock()
+		assert.Empty(t, client.pending)
+		client.mu.Unlock()
+	})
+	t.Run("interceptors", func(t *testing.T) {
+		var intercepted int64
+		opt := &Option{Interceptors: []UnaryClientInterceptor{
+			func(ctx context.Context, serviceMethod string, args, reply interface{}, client *Client, invoker UnaryInvoker) error {
+				atomic.AddInt64(&intercepted, 1)
+				if serviceMethod == "Foo.Denied" {
+					return NewError(PermissionDenied, "denied by interceptor")
+				}
+				err := invoker(ctx, serviceMethod, args, reply)
+				if ErrorCode(err) == NotFound {
+					// retried alone after the batch
+					return invoker(ctx, "Foo.Sum", args, reply)
+				}
+				return err
+			},
+		}}
+		client, err := Dial("tcp", l.Addr().String(), opt)
+		assert.Nil(t, err)
+		defer func() { _ = client.Close() }()
+		calls := make([]*Call, 10)
+		replies := make([]int, len(calls))
+		for i := range calls {
+			calls[i] = &Call{ServiceMethod: "Foo.Sum", Args: Args{Num1: i, Num2: i}, Reply: &replies[i]}
+		}
+		calls[1].ServiceMethod = "Foo.Denied"
+		calls[2].ServiceMethod = "Foo.Unknown"
+		err = client.CallBatch(context.Background(), calls)
+		assert.Equal(t, PermissionDenied, ErrorCode(err))
+		assert.Equal(t, int64(len(calls)), atomic.LoadInt64(&intercepted), "interceptors should run for every call")
+		for i, call := range calls {
+			if i == 1 {
+				assert.Equal(t, PermissionDenied, ErrorCode(call.Error))
+				continue
+			}
+			assert.Nil(t, call.Error)
+			assert.Equal(t, 2*i, replies[i])
+		}
+	})
+}
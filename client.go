@@ -3,7 +3,6 @@ package yarpc
 import (
 	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -19,12 +18,16 @@ import (
 // Call store all infomation of a call for client
 type Call struct {
 	Seq           uint64
-	ServiceMethod string      // format "<service>.<method>"
-	Args          interface{} // arguments to the function
-	Reply         interface{} // reply from the function
-	Error         error       // if error occurs, it will be set
-	Done          chan *Call  // Strobes when call is complete.
-	ServerID      int         // server do this call
+	ServiceMethod string        // format "<service>.<method>"
+	Args          interface{}   // arguments to the function
+	Reply         interface{}   // reply from the function
+	Error         error         // if error occurs, it will be set
+	Done          chan *Call    // Strobes when call is complete.
+	ServerID      int           // server do this call
+	Trailer       Metadata      // metadata set by server with the response
+	deadline      time.Time     // deadline of the caller's context, zero means no deadline
+	meta          Metadata      // outgoing metadata of the caller's context
+	stream        *ClientStream // receives the messages of a streaming call
 }
 
 func (call *Call) done() {
@@ -38,26 +41,36 @@ func (call *Call) done() {
 type Client struct {
 	cc  codec.Codec
 	opt *Option
-	// sending 是一个互斥锁，和服务端类似，为了保证请求的有序发送，即防止出现多个请求报文混淆。
-	sending sync.Mutex
-	// header 是每个请求的消息头，header 只有在请求发送时才需要，
-	// 而请求发送是互斥的，因此每个客户端只需要一个，声明在 Client 结构体中可以复用。
-	header codec.Header
-	mu     sync.Mutex // protect following
-	seq    uint64
+	// cc.Write 可以并发调用，请求按 Seq 分道交错发送（见 codec/frame.go），因此发送请求无需互斥。
+	mu  sync.Mutex // protect following
+	seq uint64
 	// pending 存储未处理完的请求，键是编号，值是 Call 实例。
 	pending map[uint64]*Call
 	// closing 和 shutdown 任意一个值置为 true，则表示 Client 处于不可用的状态，但有些许的差别，
 	// closing 是用户主动关闭的，即调用 Close 方法，而 shutdown 置为 true 一般是有错误发生。
 	closing  bool // user has called Close
 	shutdown bool // server has told us to stop
+	// goaway 表示服务端正在关闭，不再发送新请求，已发出的请求仍等待响应
+	goaway bool
+	// features 是握手时服务端确认开启的可选特性
+	features Feature
+	// heartbeat 在连接空闲时发送 ping，探测已经断开的服务端，nil 表示未开启
+	heartbeat *heartbeat
+	// unusable 在客户端不能再发送新请求时关闭（收到 GOAWAY 或连接断开），ReconnectClient 据此重连
+	unusable chan struct{}
+	// drained 在客户端不可用且没有待完成的请求时关闭，此后可以安全地关闭连接
+	drained chan struct{}
 }
 
 // make sure Client implement all way in io.Closer
 var _ io.Closer = (*Client)(nil)
 
 // ErrShutdown is errors of connect shutdown
-var ErrShutdown = errors.New("connection is shutdown")
+var ErrShutdown error = NewError(Unavailable, "connection is shutdown")
+
+// ErrGoAway is returned for calls made after server has sent GOAWAY,
+// the call is not sent and may be retried on another connection
+var ErrGoAway error = NewError(Unavailable, "rpc client: server is going away")
 
 // Close the connection
 func (client *Client) Close() error {
@@ -74,15 +87,15 @@ func (client *Client) Close() error {
 func (client *Client) IsAvailable() bool {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	return !client.shutdown && !client.closing
+	return !client.shutdown && !client.closing && !client.goaway
 }
 
 // 将参数 call 添加到 client.pending 中，并更新 client.seq
 func (client *Client) registerCall(call *Call) (uint64, error) {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	if client.closing || client.shutdown {
-		return 0, ErrShutdown
+	if err := client.unavailableLocked(); err != nil {
+		return 0, err
 	}
 	call.Seq = client.seq
 	client.pending[call.Seq] = call
@@ -90,33 +103,59 @@ func (client *Client) registerCall(call *Call) (uint64, error) {
 	return call.Seq, nil
 }
 
+// unavailableLocked returns the reason why no new call can be sent, client.mu must be held
+func (client *Client) unavailableLocked() error {
+	if client.closing || client.shutdown {
+		return ErrShutdown
+	}
+	if client.goaway {
+		return ErrGoAway
+	}
+	return nil
+}
+
+// keepaliveTimeout marks the client shutdown and fails pending calls once server doesn't answer ping,
+// the connection is closed then, so that receive stops waiting.
+func (client *Client) keepaliveTimeout() {
+	client.terminateCalls(errKeepaliveTimeout)
+	_ = client.cc.Close()
+}
+
 // removeCall 根据 seq，从 client.pending 中移除对应的 call，并返回
 func (client *Client) removeCall(seq uint64) *Call {
 	client.mu.Lock()
 	defer client.mu.Unlock()
 	call := client.pending[seq]
 	delete(client.pending, seq)
+	client.checkDrainedLocked()
 	return call
 }
 
 // terminateCalls terminateCalls：
 // 服务端或客户端发生错误时调用，将 shutdown 设置为 true，且将错误信息通知所有 pending 状态的 call
 func (client *Client) terminateCalls(err error) {
-	client.sending.Lock()
-	defer client.sending.Unlock()
 	client.mu.Lock()
 	defer client.mu.Unlock()
 	client.shutdown = true
-	for _, call := range client.pending {
-		call.Error = err
+	// the connection is broken, pending calls may be retried on another one
+	var e *Error
+	if !errors.As(err, &e) {
+		e = wrapError(Unavailable, err)
+	}
+	// calls are removed, so that a send failing at the same time won't finish them again
+	for seq, call := range client.pending {
+		delete(client.pending, seq)
+		call.Error = e
 		call.done()
 	}
+	client.checkDrainedLocked()
 }
 
 // 对一个客户端端来说，接收响应、发送请求是最重要的 2 个功能。那么首先实现接收功能，接收到的响应有三种情况：
 // call 不存在，可能是请求没有发送完整，或者因为其他原因被取消，但是服务端仍旧处理了。
 // call 存在，但服务端处理出错，即 h.Error 不为空。
 // call 存在，服务端处理正常，那么需要从 body 中读取 Reply 的值。
+// 此外服务端关闭前会发送 GOAWAY 消息，此后不再发送新请求。
 func (client *Client) receive() {
 	var err error
 	for err == nil {
@@ -124,6 +163,26 @@ func (client *Client) receive() {
 		if err = client.cc.ReadHeader(&h); err != nil {
 			break
 		}
+		client.heartbeat.alive()
+		if h.Kind == codec.KindPing || h.Kind == codec.KindPong {
+			if h.Kind == codec.KindPing {
+				pong(client.cc)
+			}
+			err = client.cc.ReadBody(nil)
+			continue
+		}
+		if h.Kind == codec.KindGoAway {
+			client.mu.Lock()
+			client.goaway = true
+			client.markUnusableLocked()
+			client.mu.Unlock()
+			err = client.cc.ReadBody(nil)
+			continue
+		}
+		if h.Kind == codec.KindStreamMsg || h.Kind == codec.KindStreamWindow {
+			err = client.receiveStream(&h)
+			continue
+		}
 		call := client.removeCall(h.Seq)
 		switch {
 		case call == nil:
@@ -131,48 +190,105 @@ func (client *Client) receive() {
 			// and call was already removed.
 			err = client.cc.ReadBody(nil)
 		case h.Error != "":
-			call.Error = fmt.Errorf(h.Error)
+			call.Trailer = h.Meta
+			call.Error = errorFromHeader(&h)
 			err = client.cc.ReadBody(nil)
 			call.done()
 		default:
 			call.ServerID = h.ServerID
-			err = client.cc.ReadBody(call.Reply)
-			if err != nil {
-				call.Error = errors.New("reading body" + err.Error())
+			call.Trailer = h.Meta
+			// a bad body only fails this call, the next frame is still readable
+			if e := client.cc.ReadBody(call.Reply); e != nil {
+				call.Error = Errorf(Internal, "reading body %s", e)
 			}
 			call.done()
 		}
 	}
 	// error occurs, so terminateCalls pending calls
+	client.heartbeat.close()
 	client.terminateCalls(err)
+	client.mu.Lock()
+	client.markUnusableLocked()
+	client.mu.Unlock()
+}
+
+// markUnusableLocked closes client.unusable once, client.mu must be held
+func (client *Client) markUnusableLocked() {
+	select {
+	case <-client.unusable:
+	default:
+		close(client.unusable)
+	}
+	client.checkDrainedLocked()
+}
+
+// checkDrainedLocked closes client.drained once the client is unusable and no call is pending,
+// client.mu must be held
+func (client *Client) checkDrainedLocked() {
+	select {
+	case <-client.unusable:
+	default:
+		return
+	}
+	if len(client.pending) > 0 {
+		return
+	}
+	select {
+	case <-client.drained:
+	default:
+		close(client.drained)
+	}
 }
 
 // NewClient cereate a client instance called by Dial() entry funciton
-// 创建 Client 实例时，首先需要完成一开始的协议交换，即发送 Option 信息给服务端。
+// 创建 Client 实例时，首先需要完成一开始的协议交换，即发送 Option 信息给服务端，
+// 并等待服务端的 ack，CodecType 等协商失败时直接返回服务端给出的原因。
 // 协商好消息的编解码方式之后，再创建一个子协程调用 receive() 接收响应。
 func NewClient(conn net.Conn, opt *Option) (client *Client, err error) {
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	if f == nil {
+	f, ok := codec.Lookup(opt.CodecType)
+	if !ok {
 		err = fmt.Errorf("invalid codec type %s", opt.CodecType)
 		log.Println("rpc client: codec error:", err)
 		return
 	}
 	// send options with server
-	if err = json.NewEncoder(conn).Encode(opt); err != nil {
+	if err = writeOption(conn, opt); err != nil {
 		log.Println("rpc client: options error: ", err)
 		return
 	}
-	return newClientCodec(f(conn), opt), nil
+	// wait for server to acknowledge the option
+	n, err := readHandshakeReply(conn)
+	if err != nil {
+		log.Println("rpc client: options error: ", err)
+		return
+	}
+	// use the compression accepted by server
+	if n.Compress != codec.CompressNone {
+		c, ok := codec.LookupCompressor(n.Compress)
+		if !ok {
+			err = fmt.Errorf("invalid compress type %s", n.Compress)
+			log.Println("rpc client: options error: ", err)
+			return
+		}
+		f = codec.WithCompression(f, c, opt.CompressThreshold)
+	}
+	client = newClientCodec(f(conn), opt)
+	client.features = n.Features
+	return client, nil
 }
 
 // newClientCodec real create an client and call receive to the conn
 func newClientCodec(cc codec.Codec, opt *Option) *Client {
 	client := &Client{
-		seq:     1,
-		cc:      cc,
-		opt:     opt,
-		pending: make(map[uint64]*Call),
+		seq:      1,
+		cc:       cc,
+		opt:      opt,
+		pending:  make(map[uint64]*Call),
+		unusable: make(chan struct{}),
+		drained:  make(chan struct{}),
 	}
+	ping := func() error { return client.writeControl(&codec.Header{Kind: codec.KindPing}) }
+	client.heartbeat = newHeartbeat(opt.KeepaliveInterval, opt.KeepaliveTimeout, ping, client.keepaliveTimeout)
 	go client.receive()
 	return client
 }
@@ -187,7 +303,9 @@ func parseOptions(opts ...*Option) (*Option, error) {
 	if len(opts) != 1 {
 		return nil, errors.New("Number of options is more than 1")
 	}
-	opt := opts[0]
+	// copy the option, it may be shared by clients dialing concurrently
+	o := *opts[0]
+	opt := &o
 	opt.MagicNumber = DefaultOption.MagicNumber
 	if opt.CodecType == "" {
 		opt.CodecType = DefaultOption.CodecType
@@ -197,9 +315,6 @@ func parseOptions(opts ...*Option) (*Option, error) {
 
 // 发送请求
 func (client *Client) send(call *Call) {
-	// make sure that the client will send a complete request
-	client.sending.Lock()
-	defer client.sending.Unlock()
 	// register this call.
 	seq, err := client.registerCall(call)
 	if err != nil {
@@ -207,14 +322,8 @@ func (client *Client) send(call *Call) {
 		call.done()
 		return
 	}
-	// prepare request header
-	client.header.ServiceMethod = call.ServiceMethod
-	client.header.Seq = call.Seq
-	// default set ServerID to be 0
-	client.header.ServerID = 0
-	client.header.Error = ""
 	// encode and send the request
-	if err := client.cc.Write(&client.header, call.Args); err != nil {
+	if err := client.cc.Write(requestHeader(call), call.Args); err != nil {
 		call := client.removeCall(seq)
 		// call may be nil, it usually means that Write partially failed,
 		// client has received the response and handled
@@ -225,48 +334,126 @@ func (client *Client) send(call *Call) {
 	}
 }
 
-// Go invokes the function asynchronously.
-// It returns the Call structure representing the invocation.
-func (client *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+// requestHeader prepares the header of a registered call, ServerID defaults to 0
+func requestHeader(call *Call) *codec.Header {
+	return &codec.Header{
+		ServiceMethod: call.ServiceMethod,
+		Seq:           call.Seq,
+		Kind:          codec.KindCall,
+		Meta:          call.meta,
+		// carry the remaining time of caller's deadline to server
+		Timeout: timeoutOf(call.deadline),
+	}
+}
+
+// timeoutOf returns the Header.Timeout of deadline, 0 means no deadline
+func timeoutOf(deadline time.Time) time.Duration {
+	if deadline.IsZero() {
+		return 0
+	}
+	if timeout := time.Until(deadline); timeout > 0 {
+		return timeout
+	}
+	return 1 // already expired, 0 would mean no deadline
+}
+
+// sendCancel tells server to stop handling the call seq,
+// it's sent when the caller's context ends before the response arrives.
+func (client *Client) sendCancel(seq uint64) {
+	if err := client.writeControl(&codec.Header{Seq: seq, Kind: codec.KindCancel}); err != nil {
+		log.Println("rpc client: send cancel error:", err)
+	}
+}
+
+// writeControl sends a control message, which has no body
+func (client *Client) writeControl(h *codec.Header) error {
+	return client.cc.Write(h, nil)
+}
+
+func newCall(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
 	if done == nil {
 		done = make(chan *Call, 10)
 	} else if cap(done) == 0 {
 		log.Panic("rpc client: done channel is unbuffered")
 	}
-	call := &Call{
+	return &Call{
 		ServiceMethod: serviceMethod,
 		Args:          args,
 		Reply:         reply,
 		Done:          done,
 	}
+}
+
+// Go invokes the function asynchronously.
+// It returns the Call structure representing the invocation.
+func (client *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	call := newCall(serviceMethod, args, reply, done)
 	client.send(call)
 	return call
 }
 
-// CallWithoutServerID invokes the named function, waits for it to complete,
-// and returns its error status.
+// call invokes the named function through client interceptors,
+// the returned Call is the last one sent to server, which is nil if no call is sent.
+func (client *Client) call(ctx context.Context, serviceMethod string, args, reply interface{}) (*Call, error) {
+	var last *Call
+	var invoker UnaryInvoker = func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+		call, err := client.invoke(ctx, serviceMethod, args, reply)
+		last = call
+		return err
+	}
+	if len(client.opt.Interceptors) > 0 {
+		invoker = chainUnaryClient(client.opt.Interceptors, client, invoker)
+	}
+	err := invoker(ctx, serviceMethod, args, reply)
+	return last, err
+}
+
+// invoke sends the request with ctx's deadline and waits for it to complete.
 // Client.Call 的超时处理机制，使用 context 包实现，控制权交给用户，控制更为灵活。
-func (client *Client) CallWithoutServerID(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+// ctx 的 deadline 和元数据会随请求发送给服务端，ctx 结束时如果请求还未完成，
+// 会发送取消消息，服务端随即取消对应请求的处理。
+func (client *Client) invoke(ctx context.Context, serviceMethod string, args, reply interface{}) (*Call, error) {
+	call := newCall(serviceMethod, args, reply, make(chan *Call, 1))
+	call.deadline, _ = ctx.Deadline()
+	call.meta, _ = FromOutgoingContext(ctx)
+	client.send(call)
 	select {
 	case <-ctx.Done():
-		client.removeCall(call.Seq)
-		return errors.New("rpc client:call failed:" + ctx.Err().Error())
+		if client.removeCall(call.Seq) != nil {
+			client.sendCancel(call.Seq)
+		}
+		return call, contextError(ctx)
 	case call := <-call.Done:
-		return call.Error
+		if trailer := trailerFromContext(ctx); trailer != nil {
+			*trailer = call.Trailer
+		}
+		return call, call.Error
+	}
+}
+
+// contextError is the error of a call not completed when ctx ends
+func contextError(ctx context.Context) error {
+	return &Error{
+		Code:    AsError(ctx.Err()).Code,
+		Message: "rpc client:call failed:" + ctx.Err().Error(),
+		cause:   ctx.Err(),
 	}
 }
 
+// CallWithoutServerID invokes the named function, waits for it to complete,
+// and returns its error status.
+func (client *Client) CallWithoutServerID(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	_, err := client.call(ctx, serviceMethod, args, reply)
+	return err
+}
+
 // Call return error and serverID
 func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) (int, error) {
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
-	select {
-	case <-ctx.Done():
-		client.removeCall(call.Seq)
-		return call.ServerID, errors.New("rpc client:call failed:" + ctx.Err().Error())
-	case call := <-call.Done:
-		return call.ServerID, call.Error
+	call, err := client.call(ctx, serviceMethod, args, reply)
+	if call == nil {
+		return 0, err
 	}
+	return call.ServerID, err
 }
 
 type clientResult struct {
@@ -281,11 +468,17 @@ type newClientFunc func(conn net.Conn, opt *Option) (client *Client, err error)
 // 2）使用子协程执行 NewClient，执行完成后则通过信道 ch 发送结果，
 // 如果 time.After() 信道先接收到消息，则说明 NewClient 执行超时，返回错误
 func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (client *Client, err error) {
+	return dialContext(context.Background(), f, network, address, opts...)
+}
+
+// dialContext is dialTimeout which also gives up once ctx ends
+func dialContext(ctx context.Context, f newClientFunc, network, address string, opts ...*Option) (client *Client, err error) {
 	opt, err := parseOptions(opts...)
 	if err != nil {
 		return nil, err
 	}
-	conn, err := net.DialTimeout(network, address, opt.ConnectTimeout)
+	d := net.Dialer{Timeout: opt.ConnectTimeout}
+	conn, err := d.DialContext(ctx, network, address)
 	if err != nil {
 		return nil, err
 	}
@@ -295,21 +488,30 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (cli
 			_ = conn.Close()
 		}
 	}()
-	ch := make(chan clientResult)
+	ch := make(chan clientResult, 1)
 	go func() {
 		client, err := f(conn, opt)
 		ch <- clientResult{client: client, err: err}
 	}()
-	if opt.ConnectTimeout == 0 {
-		result := <-ch
-		return result.client, result.err
+	var timeout <-chan time.Time
+	if opt.ConnectTimeout > 0 {
+		timeout = time.After(opt.ConnectTimeout)
 	}
 	select {
-	case <-time.After(opt.ConnectTimeout):
-		return nil, fmt.Errorf("rpc client: connect timeout: expect within %s", opt.ConnectTimeout)
+	case <-timeout:
+		err = fmt.Errorf("rpc client: connect timeout: expect within %s", opt.ConnectTimeout)
+	case <-ctx.Done():
+		err = contextError(ctx)
 	case result := <-ch:
 		return result.client, result.err
 	}
+	// the client may still be created after giving up
+	go func() {
+		if result := <-ch; result.client != nil {
+			_ = result.client.Close()
+		}
+	}()
+	return nil, err
 }
 
 // Dial connects to an RPC server at the specified network address
@@ -344,6 +546,11 @@ func DialHTTP(network, address string, opts ...*Option) (*Client, error) {
 // rpcAddr is a general format (protocol@addr) to represent a rpc server
 // eg, http@10.0.0.1:7001, tcp@10.0.0.1:9999, unix@/tmp/yarpc.sock
 func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
+	return XDialContext(context.Background(), rpcAddr, opts...)
+}
+
+// XDialContext is XDial which gives up once ctx ends
+func XDialContext(ctx context.Context, rpcAddr string, opts ...*Option) (*Client, error) {
 	parts := strings.Split(rpcAddr, "@")
 	if len(parts) != 2 {
 		return nil, fmt.Errorf("rpc client err: wrong format '%s', expect protocol@addr", rpcAddr)
@@ -351,9 +558,9 @@ func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
 	protocol, addr := parts[0], parts[1]
 	switch protocol {
 	case "http":
-		return DialHTTP("tcp", addr, opts...)
+		return dialContext(ctx, NewHTTPClient, "tcp", addr, opts...)
 	default:
 		// tcp, unix or other transport protocol
-		return Dial(protocol, addr, opts...)
+		return dialContext(ctx, NewClient, protocol, addr, opts...)
 	}
 }
@@ -8,6 +8,9 @@ import (
 	"strings"
 	"testing"
 	"time"
+	"yarpc/codec"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 // 第一个测试用例，用于测试连接超时。NewClient 函数耗时 2s，
@@ -42,6 +45,15 @@ func (b Bar) Timeout(argv int, reply *int) error {
 	return nil
 }
 
+// Bar.Wait blocks until the request is cancelled by server
+func (b Bar) Wait(ctx context.Context, argv int, reply *int) error {
+	<-ctx.Done()
+	cancelled <- ctx.Err()
+	return ctx.Err()
+}
+
+var cancelled = make(chan error, 1)
+
 func startServer(addr chan string) {
 	var b Bar
 	_ = Register(&b)
@@ -59,18 +71,51 @@ func TestClient_Call(t *testing.T) {
 	time.Sleep(time.Second)
 	t.Run("client timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr)
-		ctx, _ := context.WithTimeout(context.Background(), time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
 		var reply int
-		err := client.Call(ctx, "Bar.Timeout", 1, &reply)
+		_, err := client.Call(ctx, "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), ctx.Err().Error()), "expect a timeout error")
+		_assert(ErrorCode(err) == DeadlineExceeded, "expect DeadlineExceeded, got %s", ErrorCode(err))
 	})
 	t.Run("server handle timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr, &Option{
 			HandleTimeout: time.Second,
 		})
 		var reply int
-		err := client.Call(context.Background(), "Bar.Timeout", 1, &reply)
+		_, err := client.Call(context.Background(), "Bar.Timeout", 1, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
+		_assert(ErrorCode(err) == DeadlineExceeded, "expect DeadlineExceeded, got %s", ErrorCode(err))
+	})
+	t.Run("server handle timeout cancels context", func(t *testing.T) {
+		client, _ := Dial("tcp", addr, &Option{
+			HandleTimeout: 100 * time.Millisecond,
+		})
+		var reply int
+		_, err := client.Call(context.Background(), "Bar.Wait", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
+		_assert(<-cancelled == context.DeadlineExceeded, "expect handler context to be cancelled")
+	})
+	t.Run("client cancel propagates to server", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		var reply int
+		_, err := client.Call(ctx, "Bar.Wait", 1, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), context.Canceled.Error()), "expect a cancel error")
+		_assert(<-cancelled == context.Canceled, "expect handler context to be cancelled by client")
+	})
+	t.Run("client deadline propagates to server", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		var reply int
+		_, _ = client.Call(ctx, "Bar.Wait", 1, &reply)
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("expect handler context to end with client deadline")
+		}
 	})
 }
 
@@ -82,7 +127,8 @@ func TestXDial(t *testing.T) {
 			_ = os.Remove(addr)
 			l, err := net.Listen("unix", addr)
 			if err != nil {
-				t.Fatal("failed to listen unix socket")
+				t.Error("failed to listen unix socket")
+				return
 			}
 			ch <- struct{}{}
 			Accept(l)
@@ -92,3 +138,55 @@ func TestXDial(t *testing.T) {
 		_assert(err == nil, "failed to connect unix socket")
 	}
 }
+
+type Proto int
+
+func (p Proto) Double(args *wrapperspb.Int64Value, reply *wrapperspb.Int64Value) error {
+	reply.Value = args.Value * 2
+	return nil
+}
+
+func TestClient_CallProtobuf(t *testing.T) {
+	var p Proto
+	server := NewServer(1)
+	_ = server.Register(&p)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.ProtobufType})
+	_assert(err == nil, "failed to dial with protobuf codec")
+	defer func() { _ = client.Close() }()
+	var reply wrapperspb.Int64Value
+	serverID, err := client.Call(context.Background(), "Proto.Double", wrapperspb.Int64(21), &reply)
+	_assert(err == nil && reply.Value == 42 && serverID == 1, "expect 42 from server 1")
+	_, err = client.Call(context.Background(), "Proto.Triple", wrapperspb.Int64(21), &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect method not found")
+}
+
+type Blob int
+
+func (b Blob) Get(n int, reply *[]byte) error {
+	*reply = make([]byte, n)
+	return nil
+}
+
+// 大响应被切块发送，与同一连接上其他调用的响应交错，
+// 块的交错顺序由 codec 的 TestFrameConn_interleave 验证，这里验证两个调用的结果都完整
+func TestClient_largeReply(t *testing.T) {
+	t.Parallel()
+	server := NewServer(0)
+	_ = server.Register(new(Blob))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var large []byte
+	call := client.Go("Blob.Get", 4<<20, &large, nil)
+	var small []byte
+	_, err = client.Call(context.Background(), "Blob.Get", 8, &small)
+	_assert(err == nil && len(small) == 8, "small call error: %v", err)
+	<-call.Done
+	_assert(call.Error == nil && len(large) == 4<<20, "large call error: %v", call.Error)
+}
@@ -1,6 +1,13 @@
 package codec
 
-import "io"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
 
 // Header will be used by client to request and server to reply
 type Header struct {
@@ -8,8 +15,48 @@ type Header struct {
 	Seq           uint64 // sequence number chosen by client
 	ServerID      int    // sequence used by server
 	Error         string
+	Code          uint32            // status code of Error, see yarpc.Code
+	Details       map[string]string // optional details of Error
+	Kind          Kind              // call or control message
+	// Timeout 是客户端 context 的剩余时间，服务端据此设置处理的 deadline，
+	// 使用相对时间而不是绝对时间，避免两端时钟不一致，0 表示没有 deadline
+	Timeout time.Duration
+	// Meta 是请求的元数据，或者是响应中服务端设置的 trailer
+	Meta map[string]string
+	// Window 是流控消息中授予对端的额外消息数，见 KindStreamWindow
+	Window uint32
 }
 
+// Kind distinguishes calls from control messages
+type Kind uint8
+
+const (
+	// KindCall is a request or the response of a call
+	KindCall Kind = iota
+	// KindCancel tells server to cancel the call with the same Seq, it has no body
+	KindCancel
+	// KindGoAway tells client that server is shutting down and no new call
+	// should be sent on the connection, pending calls are still answered, it has no body
+	KindGoAway
+	// KindStreamMsg is a message of the stream call with the same Seq,
+	// the stream ends with the response of the call, which has no body
+	KindStreamMsg
+	// KindStreamEnd tells server that client won't send more messages
+	// on the stream with the same Seq, it has no body
+	KindStreamEnd
+	// KindStreamWindow allows the peer to send Header.Window more messages
+	// on the stream with the same Seq, it has no body
+	KindStreamWindow
+	// KindOneWay is a request whose caller doesn't wait for the response,
+	// server handles it like KindCall but never replies
+	KindOneWay
+	// KindPing asks the peer to answer with KindPong at once, so that a dead peer is detected,
+	// it has no body
+	KindPing
+	// KindPong answers KindPing, it has no body
+	KindPong
+)
+
 // Codec is the gob/json encoder/decoder interface.
 type Codec interface {
 	io.Closer
@@ -17,10 +64,78 @@ type Codec interface {
 	ReadHeader(*Header) error
 	// decode body
 	ReadBody(interface{}) error
-	// encode header & body
+	// encode header & body as one frame, nil body is not encoded.
+	// Write is safe for concurrent use, frames of different Header.Seq are interleaved.
 	Write(*Header, interface{}) error
 }
 
+// RawBodyCodec is implemented by codecs that can keep a body undecoded,
+// so that the body is decoded later when its type is known.
+// Server needs it to receive messages of client streams, all codecs in this package implement it.
+type RawBodyCodec interface {
+	// ReadRawBody returns a copy of the undecoded body of the frame being read
+	ReadRawBody() ([]byte, error)
+	// DecodeBody decodes raw returned by ReadRawBody into body
+	DecodeBody(raw []byte, body interface{}) error
+}
+
+// BatchCodec is implemented by codecs that can write many frames with one flush,
+// all codecs in this package implement it.
+type BatchCodec interface {
+	// WriteBatch encodes hs[i] & bodies[i] as frames and writes them at once.
+	// Nothing is written if any of them fails to encode.
+	WriteBatch(hs []*Header, bodies []interface{}) error
+}
+
+// frameCodec is embedded by the codecs in this package, which write each header & body as one frame.
+// It implements Write, WriteBatch, SetCompressor and Close of them with encode.
+type frameCodec struct {
+	// frames 包装了由构建函数传入的 conn，通常是通过 TCP 或者 Unix 建立 socket 时得到的链接实例
+	frames *FrameConn
+	// encode returns a copy of header and body encoded, it's safe for concurrent use
+	encode func(h *Header, body interface{}) ([]byte, error)
+}
+
+// Write header and body into conn as one frame
+func (c *frameCodec) Write(h *Header, body interface{}) error {
+	payload, err := c.encode(h, body)
+	if err != nil {
+		return err
+	}
+	if err := c.frames.WriteFrame(h, payload); err != nil {
+		_ = c.Close()
+		return err
+	}
+	return nil
+}
+
+// WriteBatch writes headers and bodies into conn as frames, they're flushed together
+func (c *frameCodec) WriteBatch(hs []*Header, bodies []interface{}) error {
+	payloads := make([][]byte, len(hs))
+	for i, h := range hs {
+		payload, err := c.encode(h, bodies[i])
+		if err != nil {
+			return err
+		}
+		payloads[i] = payload
+	}
+	if err := c.frames.WriteFrames(hs, payloads); err != nil {
+		_ = c.Close()
+		return err
+	}
+	return nil
+}
+
+// SetCompressor compresses frames with compressor, see Compressible
+func (c *frameCodec) SetCompressor(compressor Compressor, threshold int) {
+	c.frames.SetCompressor(compressor, threshold)
+}
+
+// Close close the conn
+func (c *frameCodec) Close() error {
+	return c.frames.Close()
+}
+
 // NewCodecFunc is a Codec encoder/decoder constructor func
 // return a Codec object
 // ReadWriteCloser is the interface that groups the basic Read, Write and Close methods.
@@ -30,15 +145,61 @@ type NewCodecFunc func(io.ReadWriteCloser) Codec
 type Type string
 
 const (
-	GobType  Type = "application/gob"
-	JsonType Type = "application/json"
+	GobType      Type = "application/gob"
+	JsonType     Type = "application/json"
+	ProtobufType Type = "application/protobuf"
+	MsgpackType  Type = "application/msgpack"
 )
 
-// NewCodecFuncMap is a Codec encoder/decoder constructor function map
-var NewCodecFuncMap map[Type]NewCodecFunc
+// MaxTypeLen is the max length of a codec type, which is sent in the handshake with a uint8 length
+const MaxTypeLen = 255
+
+var (
+	codecsMu sync.RWMutex // protect following
+	codecs   = make(map[Type]NewCodecFunc)
+)
+
+// Register makes a Codec constructor available by codec type,
+// it's safe for concurrent use and rejects duplicated types or types longer than MaxTypeLen.
+func Register(t Type, f NewCodecFunc) error {
+	if t == "" || f == nil {
+		return errors.New("rpc codec: register empty codec type or nil constructor")
+	}
+	if len(t) > MaxTypeLen {
+		return fmt.Errorf("rpc codec: codec type longer than %d bytes: %s", MaxTypeLen, t)
+	}
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, dup := codecs[t]; dup {
+		return errors.New("rpc codec: codec already registered: " + string(t))
+	}
+	codecs[t] = f
+	return nil
+}
+
+// Lookup returns the Codec constructor registered with t
+func Lookup(t Type) (NewCodecFunc, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	f, ok := codecs[t]
+	return f, ok
+}
+
+// Types returns all registered codec types in sorted order
+func Types() []Type {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	types := make([]Type, 0, len(codecs))
+	for t := range codecs {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
 
 func init() {
-	NewCodecFuncMap = make(map[Type]NewCodecFunc)
-	NewCodecFuncMap[GobType] = NewGobCodec
-	NewCodecFuncMap[JsonType] = NewJsonCodec
+	_ = Register(GobType, NewGobCodec)
+	_ = Register(JsonType, NewJsonCodec)
+	_ = Register(ProtobufType, NewProtobufCodec)
+	_ = Register(MsgpackType, NewMsgpackCodec)
 }
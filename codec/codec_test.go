@@ -0,0 +1,263 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// bufConn is an in-memory io.ReadWriteCloser
+type bufConn struct {
+	bytes.Buffer
+}
+
+func (c *bufConn) Close() error { return nil }
+
+var _ io.ReadWriteCloser = (*bufConn)(nil)
+
+func TestCodec_skipBadBody(t *testing.T) {
+	for _, typ := range []Type{GobType, JsonType, MsgpackType} {
+		f, _ := Lookup(typ)
+		t.Run(string(typ), func(t *testing.T) {
+			conn := new(bufConn)
+			cc := f(conn)
+			assert.Nil(t, cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, "not a number"))
+			assert.Nil(t, cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, 42))
+
+			var h Header
+			var n int
+			assert.Nil(t, cc.ReadHeader(&h))
+			assert.NotNil(t, cc.ReadBody(&n), "body of wrong type should fail")
+			// the second frame is still readable
+			assert.Nil(t, cc.ReadHeader(&h))
+			assert.Equal(t, uint64(2), h.Seq)
+			assert.Nil(t, cc.ReadBody(&n))
+			assert.Equal(t, 42, n)
+		})
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	conn := new(bufConn)
+	cc := NewProtobufCodec(conn)
+	meta := map[string]string{"trace-id": "1", "tenant": "yarpc"}
+	assert.Nil(t, cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1, Meta: meta}, wrapperspb.Int64(42)))
+	details := map[string]string{"service_method": "Foo.Sum"}
+	assert.Nil(t, cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2, Error: "failed", Code: 13, Details: details}, struct{}{}))
+	assert.NotNil(t, cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 3}, 42), "body must be proto.Message")
+
+	var h Header
+	var v wrapperspb.Int64Value
+	assert.Nil(t, cc.ReadHeader(&h))
+	assert.Equal(t, Header{ServiceMethod: "Foo.Sum", Seq: 1, Meta: meta}, h)
+	assert.Nil(t, cc.ReadBody(&v))
+	assert.Equal(t, int64(42), v.Value)
+	assert.Nil(t, cc.ReadHeader(&h))
+	assert.Equal(t, Header{ServiceMethod: "Foo.Sum", Seq: 2, Error: "failed", Code: 13, Details: details}, h)
+	assert.Nil(t, cc.ReadBody(nil))
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	conn := new(bufConn)
+	cc := NewMsgpackCodec(conn)
+	reply := map[string]interface{}{"sum": 3, "names": []string{"a", "b"}}
+	assert.Nil(t, cc.Write(&Header{ServiceMethod: "Foo.Map", Seq: 1, ServerID: 2}, &reply))
+	assert.Nil(t, cc.Write(&Header{ServiceMethod: "Foo.Map", Seq: 2, Error: "failed"}, struct{}{}))
+	assert.Nil(t, cc.Write(&Header{ServiceMethod: "Foo.Slice", Seq: 3}, &[]int{1, 2}))
+
+	var h Header
+	assert.Nil(t, cc.ReadHeader(&h))
+	assert.Equal(t, Header{ServiceMethod: "Foo.Map", Seq: 1, ServerID: 2}, h)
+	got := make(map[string]interface{})
+	assert.Nil(t, cc.ReadBody(&got))
+	assert.Equal(t, int64(3), got["sum"])
+	assert.Equal(t, []interface{}{"a", "b"}, got["names"])
+	// error response, body is discarded
+	assert.Nil(t, cc.ReadHeader(&h))
+	assert.Equal(t, "failed", h.Error)
+	assert.Nil(t, cc.ReadBody(nil))
+	assert.Nil(t, cc.ReadHeader(&h))
+	var slice []int
+	assert.Nil(t, cc.ReadBody(&slice))
+	assert.Equal(t, []int{1, 2}, slice)
+}
+
+// opaqueCodec hides Compressible of the codec it wraps
+type opaqueCodec struct {
+	Codec
+}
+
+func TestWithCompression(t *testing.T) {
+	constructors := map[string]NewCodecFunc{
+		"frame": NewGobCodec,
+		// codecs not implementing Compressible are compressed by blocks
+		"block": func(conn io.ReadWriteCloser) Codec { return opaqueCodec{NewGobCodec(conn)} },
+	}
+	for name, f := range constructors {
+		for _, typ := range []CompressType{CompressGzip, CompressSnappy, CompressZstd} {
+			t.Run(name+"/"+string(typ), func(t *testing.T) {
+				c, ok := LookupCompressor(typ)
+				assert.True(t, ok)
+				conn := new(bufConn)
+				cc := WithCompression(f, c, 0)(conn)
+				large := strings.Repeat("yarpc", DefaultCompressThreshold)
+				assert.Nil(t, cc.Write(&Header{Seq: 1}, large))
+				assert.Less(t, conn.Len(), len(large), "large frame should be compressed")
+				assert.Nil(t, cc.Write(&Header{Seq: 2}, "small"))
+
+				var h Header
+				var body string
+				assert.Nil(t, cc.ReadHeader(&h))
+				assert.Nil(t, cc.ReadBody(&body))
+				assert.Equal(t, large, body)
+				assert.Nil(t, cc.ReadHeader(&h))
+				assert.Nil(t, cc.ReadBody(&body))
+				assert.Equal(t, "small", body)
+			})
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	assert.NotNil(t, Register(GobType, NewGobCodec), "duplicated type should be rejected")
+	assert.NotNil(t, Register("application/nil", nil), "nil constructor should be rejected")
+	long := Type("application/" + strings.Repeat("x", MaxTypeLen))
+	assert.NotNil(t, Register(long, NewGobCodec), "type too long for the handshake should be rejected")
+	typ := Type("application/gob-" + t.Name())
+	assert.Nil(t, Register(typ, NewGobCodec))
+	t.Cleanup(func() {
+		codecsMu.Lock()
+		defer codecsMu.Unlock()
+		delete(codecs, typ)
+	})
+	f, ok := Lookup(typ)
+	assert.True(t, ok)
+	assert.NotNil(t, f)
+	assert.Contains(t, Types(), typ)
+}
+
+func TestRawBodyCodec(t *testing.T) {
+	for _, typ := range []Type{GobType, JsonType, MsgpackType, ProtobufType} {
+		f, _ := Lookup(typ)
+		t.Run(string(typ), func(t *testing.T) {
+			conn := new(bufConn)
+			cc := f(conn)
+			assert.Nil(t, cc.Write(&Header{Seq: 1, Kind: KindStreamMsg}, wrapperspb.String("first")))
+			assert.Nil(t, cc.Write(&Header{Seq: 1, Kind: KindStreamWindow, Window: 32}, nil))
+
+			var h Header
+			assert.Nil(t, cc.ReadHeader(&h))
+			raw, err := cc.(RawBodyCodec).ReadRawBody()
+			assert.Nil(t, err)
+			// the frame buffer is reused, raw must survive the next frame
+			assert.Nil(t, cc.ReadHeader(&h))
+			assert.Equal(t, Header{Seq: 1, Kind: KindStreamWindow, Window: 32}, h)
+			var v wrapperspb.StringValue
+			assert.Nil(t, cc.(RawBodyCodec).DecodeBody(raw, &v))
+			assert.Equal(t, "first", v.Value)
+		})
+	}
+}
+
+func TestFrameConn_interleave(t *testing.T) {
+	conn := new(bufConn)
+	f := newFrameConn(conn)
+	large := bytes.Repeat([]byte("yarpc"), chunkSize)
+	var writes []*frameWrite
+	for _, w := range []struct {
+		h       *Header
+		payload []byte
+	}{
+		{&Header{Seq: 1, Kind: KindCall}, large},
+		{&Header{Seq: 2, Kind: KindCall}, []byte("small")},
+		{&Header{Seq: 1, Kind: KindCancel}, []byte("cancel")},
+	} {
+		fw, err := f.newFrameWrite(w.payload)
+		assert.Nil(t, err)
+		assert.Nil(t, f.enqueue([]*Header{w.h}, []*frameWrite{fw}))
+		writes = append(writes, fw)
+	}
+	go f.writeLoop()
+	for _, fw := range writes {
+		assert.Nil(t, <-fw.done)
+	}
+	// control messages go first, then the small frame is sent between chunks of the large one
+	for _, want := range [][]byte{[]byte("cancel"), []byte("small"), large} {
+		payload, err := f.ReadFrame()
+		assert.Nil(t, err)
+		assert.Equal(t, want, payload)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	assert.Equal(t, int64(windowSize)-f.credits, f.consumed, "window taken by writer should match bytes counted by reader")
+}
+
+func TestFrameConn_partialLimit(t *testing.T) {
+	conn := new(bufConn)
+	f := newFrameConn(conn)
+	f.partialMax = 2 * chunkSize
+	// unfinished chunks of different frames pile up
+	for id := uint32(1); id <= 3; id++ {
+		fw := &frameWrite{id: id, payload: make([]byte, chunkSize)}
+		assert.Nil(t, f.writeChunk(fw, frameChunk|frameMore, fw.payload))
+	}
+	assert.Nil(t, f.w.Flush())
+	_, err := f.ReadFrame()
+	assert.NotNil(t, err, "reader should fail once unfinished chunks exceed the limit")
+}
+
+func TestFrameConn_window(t *testing.T) {
+	c1, c2 := net.Pipe()
+	a, b := newFrameConn(c1), NewFrameConn(c2)
+	defer func() { _, _ = a.Close(), b.Close() }()
+	go func() { _, _ = a.ReadFrame() }() // handles window updates from b
+	large, err := a.newFrameWrite(make([]byte, 2*windowSize))
+	assert.Nil(t, err)
+	small, err := a.newFrameWrite([]byte("small"))
+	assert.Nil(t, err)
+	assert.Nil(t, a.enqueue([]*Header{{Seq: 1, Kind: KindCall}, {Seq: 2, Kind: KindCall}}, []*frameWrite{large, small}))
+	go a.writeLoop()
+	payloads := make(chan []byte, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			payload, err := b.ReadFrame()
+			assert.Nil(t, err)
+			payloads <- append([]byte(nil), payload...)
+		}
+	}()
+	assert.Equal(t, "small", string(<-payloads), "small frame shouldn't wait for the large one")
+	assert.Nil(t, <-small.done)
+	assert.Equal(t, 2*windowSize, len(<-payloads), "large frame should pass when window is given back")
+	assert.Nil(t, <-large.done)
+}
+
+func TestBatchCodec(t *testing.T) {
+	for _, typ := range []Type{GobType, JsonType, MsgpackType, ProtobufType} {
+		f, _ := Lookup(typ)
+		t.Run(string(typ), func(t *testing.T) {
+			conn := new(bufConn)
+			cc := f(conn).(BatchCodec)
+			hs := []*Header{{ServiceMethod: "Foo.Sum", Seq: 1}, {ServiceMethod: "Foo.Sum", Seq: 2}}
+			bodies := []interface{}{wrapperspb.String("first"), wrapperspb.String("second")}
+			assert.Nil(t, cc.WriteBatch(hs, bodies))
+			// nothing is written if any body fails to encode
+			n := conn.Len()
+			assert.NotNil(t, cc.WriteBatch(hs, []interface{}{wrapperspb.String("third"), make(chan int)}))
+			assert.Equal(t, n, conn.Len())
+
+			for i, h := range hs {
+				var got Header
+				var v wrapperspb.StringValue
+				assert.Nil(t, cc.(Codec).ReadHeader(&got))
+				assert.Equal(t, *h, got)
+				assert.Nil(t, cc.(Codec).ReadBody(&v))
+				assert.Equal(t, bodies[i].(*wrapperspb.StringValue).Value, v.Value)
+			}
+		})
+	}
+}
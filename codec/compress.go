@@ -0,0 +1,247 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 压缩
+// 压缩发生在分帧层，对所有的编解码器都生效：
+// 帧的 payload 不小于阈值时整体压缩，并在帧的 Flags 中标记，
+// 读取时根据 Flags 解压后再交给编解码器解析。
+// WithCompression 通过 Compressible 把 Compressor 显式交给基于 FrameConn 的编解码器；
+// 没有实现 Compressible 的编解码器，每次写入连接的数据按同样的格式整块压缩（blockConn），
+// 因此任何注册的编解码器都能使用压缩。
+// 压缩算法在握手时协商，服务端不支持时退化为不压缩。
+
+// CompressType enmu compression type.
+type CompressType string
+
+const (
+	CompressNone   CompressType = ""
+	CompressGzip   CompressType = "gzip"
+	CompressSnappy CompressType = "snappy"
+	CompressZstd   CompressType = "zstd"
+)
+
+// DefaultCompressThreshold is used when threshold is not set
+const DefaultCompressThreshold = 1024
+
+// Compressor compresses and decompresses frame payloads.
+// It must be safe for concurrent use.
+type Compressor interface {
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+// ErrDecompressedTooLarge is returned when a payload is larger than MaxFrameSize after decompression
+var ErrDecompressedTooLarge = errors.New("rpc codec: decompressed frame too large")
+
+var compressors = map[CompressType]Compressor{
+	CompressGzip:   new(gzipCompressor),
+	CompressSnappy: snappyCompressor{},
+	CompressZstd:   new(zstdCompressor),
+}
+
+// LookupCompressor returns the Compressor of t
+func LookupCompressor(t CompressType) (Compressor, bool) {
+	c, ok := compressors[t]
+	return c, ok
+}
+
+// Compressible is implemented by codecs that compress frames themselves,
+// all codecs in this package implement it.
+type Compressible interface {
+	// SetCompressor compresses frames not less than threshold bytes with c,
+	// it's called before the codec reads or writes anything.
+	SetCompressor(c Compressor, threshold int)
+}
+
+// WithCompression wraps the codec constructor f,
+// frames written by the codec are compressed by c when they are not less than threshold bytes.
+// Codecs implementing Compressible are given c directly,
+// writes of other codecs are compressed as blocks by the conn they're built on.
+func WithCompression(f NewCodecFunc, c Compressor, threshold int) NewCodecFunc {
+	if threshold <= 0 {
+		threshold = DefaultCompressThreshold
+	}
+	return func(conn io.ReadWriteCloser) Codec {
+		bc := &blockConn{ReadWriteCloser: conn, compressor: c, threshold: threshold}
+		cc := f(bc)
+		if x, ok := cc.(Compressible); ok {
+			x.SetCompressor(c, threshold)
+			atomic.StoreInt32(&bc.bypass, 1)
+		}
+		return cc
+	}
+}
+
+// blockConn compresses each Write as a block for codecs not implementing Compressible,
+// blocks are framed like FrameConn: | Length uint32 | Flags uint8 | Data |
+type blockConn struct {
+	io.ReadWriteCloser
+	compressor Compressor
+	threshold  int
+	bypass     int32 // 1 means the codec compresses frames itself, atomic
+
+	wmu  sync.Mutex // keep blocks of concurrent writes apart
+	rbuf []byte     // the rest of the block being read
+}
+
+func (c *blockConn) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&c.bypass) == 1 {
+		return c.ReadWriteCloser.Write(p)
+	}
+	data, flags := p, uint8(0)
+	if len(p) >= c.threshold {
+		compressed, err := c.compressor.Compress(p)
+		if err != nil {
+			return 0, err
+		}
+		if len(compressed) < len(p) {
+			data, flags = compressed, frameCompressed
+		}
+	}
+	if len(data) > MaxFrameSize {
+		return 0, ErrFrameTooLarge
+	}
+	block := make([]byte, framePrefixLen, framePrefixLen+len(data))
+	binary.BigEndian.PutUint32(block, uint32(len(data)))
+	block[4] = flags
+	block = append(block, data...)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.ReadWriteCloser.Write(block); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *blockConn) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&c.bypass) == 1 {
+		return c.ReadWriteCloser.Read(p)
+	}
+	for len(c.rbuf) == 0 {
+		var prefix [framePrefixLen]byte
+		if _, err := io.ReadFull(c.ReadWriteCloser, prefix[:]); err != nil {
+			return 0, err
+		}
+		n := binary.BigEndian.Uint32(prefix[:4])
+		if n > MaxFrameSize {
+			return 0, ErrFrameTooLarge
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(c.ReadWriteCloser, data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if prefix[4]&frameCompressed != 0 {
+			var err error
+			if data, err = c.compressor.Decompress(data); err != nil {
+				return 0, err
+			}
+		}
+		c.rbuf = data
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+type gzipCompressor struct {
+	writers sync.Pool // reuse *gzip.Writer
+}
+
+func (c *gzipCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, ok := c.writers.Get().(*gzip.Writer)
+	if !ok {
+		w = gzip.NewWriter(&buf)
+	} else {
+		w.Reset(&buf)
+	}
+	defer c.writers.Put(w)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCompressor) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+	// read one more byte to detect payloads larger than MaxFrameSize
+	dst, err := ioutil.ReadAll(io.LimitReader(r, MaxFrameSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(dst) > MaxFrameSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	return dst, nil
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (snappyCompressor) Decompress(src []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n > MaxFrameSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	return snappy.Decode(nil, src)
+}
+
+type zstdCompressor struct {
+	once sync.Once // encoder and decoder are created on first use
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+	err  error
+}
+
+func (c *zstdCompressor) init() error {
+	c.once.Do(func() {
+		if c.enc, c.err = zstd.NewWriter(nil); c.err != nil {
+			return
+		}
+		c.dec, c.err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxFrameSize))
+	})
+	return c.err
+}
+
+func (c *zstdCompressor) Compress(src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.enc.EncodeAll(src, nil), nil
+}
+
+func (c *zstdCompressor) Decompress(src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.dec.DecodeAll(src, nil)
+}
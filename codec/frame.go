@@ -0,0 +1,433 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// 分帧
+// 每一对 header + body 编码后作为一个整体，加上长度前缀后写入连接：
+// | Length uint32 | Flags uint8 | Payload [Length]byte |
+// | <-------  5 bytes  -------> | <- header + body ->  |
+// 读取时总是先把整帧读出来再交给具体的编解码器解析，
+// 因此即使 body 解析失败，连接上的字节流也不会错位，
+// 服务端可以跳过这个请求并回复错误，其他进行中的请求不受影响。
+// Flags 标记 payload 是否被压缩（见 compress.go）。
+//
+// 写队列、分块与流控
+// 每个连接有一个写协程，WriteFrame 把帧放入写队列后等待它被写入连接，调用方无需再串行化写操作。
+// 队列按 Header.Seq 分道：同一个 Seq 的帧按写入顺序发送，不同 Seq 之间以块为单位轮流发送；
+// 超过 chunkSize 的帧被切成多块，每块的 Flags 带 frameChunk，payload 以所属帧的 ID 开头：
+// | Length uint32 | Flags uint8 | ID uint32 | Chunk |
+// 除最后一块外都带 frameMore，读取时按 ID 拼回完整的帧，不同帧的块可以交错，
+// 尚未拼完的块总共最多缓存 maxPartialSize 字节，超过时认为对端异常，读取出错，
+// 这样小的调用不会被大的响应阻塞在队头。取消、流控、GOAWAY 等控制消息优先于数据发送。
+// 连接级的窗口流控：发送方最多发送 windowSize 字节对端尚未读取的数据（按帧长计，包含块的 ID），
+// 对端每读取半个窗口的数据就回复一个带 frameWindow 的帧，payload 是归还的字节数（uint32），
+// 对端读得慢时写协程停止发送，WriteFrame 随之阻塞，背压就传递给了调用方。
+
+// MaxFrameSize is the upper bound of a single frame payload
+const MaxFrameSize = 64 << 20
+
+const framePrefixLen = 4 + 1
+
+const (
+	frameCompressed uint8 = 1 << iota // payload is compressed by the negotiated Compressor
+	frameChunk                        // payload is a chunk of the frame whose ID is prefixed
+	frameMore                         // more chunks of the frame follow
+	frameWindow                       // payload is the window increment, handled by FrameConn itself
+)
+
+const (
+	chunkSize  = 16 << 10 // frames larger than it are split into chunks
+	windowSize = 1 << 20  // initial connection window in bytes
+	// maxPartialSize bounds the bytes of unfinished chunked frames buffered by the reader
+	maxPartialSize = 4 * MaxFrameSize
+	// writeBufferSize is large enough for a batch of small frames to be written at once
+	writeBufferSize = 64 << 10
+)
+
+// ErrFrameTooLarge is returned when a frame exceeds MaxFrameSize
+var ErrFrameTooLarge = errors.New("rpc codec: frame too large")
+
+// isControl reports whether the frame with header h is a control message,
+// control messages are written before data and not held back by the window
+func isControl(h *Header) bool {
+	switch h.Kind {
+	case KindCall, KindStreamMsg, KindOneWay:
+		return false
+	default:
+		return true
+	}
+}
+
+// FrameConn reads and writes length-delimited frames on top of conn.
+// ReadFrame should be called by one goroutine,
+// WriteFrame is safe for concurrent use.
+type FrameConn struct {
+	conn       io.ReadWriteCloser
+	r          *bufio.Reader
+	w          *bufio.Writer // used by writeLoop only
+	rbuf       []byte        // reused by ReadFrame
+	partial    map[uint32][]byte
+	partialLen int64      // bytes buffered in partial
+	partialMax int64      // upper bound of partialLen, maxPartialSize except in tests
+	consumed   int64      // bytes read since the last window update
+	compressor Compressor // nil means frames are never compressed
+	threshold  int        // compress payloads not less than threshold bytes
+
+	mu      sync.Mutex // protect following
+	cond    *sync.Cond // signaled when frames are queued, window grows or conn is closed
+	control []*frameWrite
+	lanes   map[uint64][]*frameWrite // data frames by Header.Seq
+	ring    []uint64                 // lanes with frames, in round-robin order
+	credits int64                    // bytes that can be sent before peer grants more
+	nextID  uint32
+	err     error // set once writing fails or conn is closed
+}
+
+// frameWrite is a frame in the write queue
+type frameWrite struct {
+	flags   uint8
+	payload []byte     // the part not written yet
+	id      uint32     // ID of a chunked frame, 0 if it's written as a whole
+	done    chan error // receives the result once the frame is flushed, nil if nobody waits
+}
+
+// NewFrameConn wraps conn with length-delimited framing,
+// frames are not compressed until SetCompressor is called.
+func NewFrameConn(conn io.ReadWriteCloser) *FrameConn {
+	f := newFrameConn(conn)
+	go f.writeLoop()
+	return f
+}
+
+// newFrameConn returns the FrameConn without starting its writeLoop
+func newFrameConn(conn io.ReadWriteCloser) *FrameConn {
+	f := &FrameConn{
+		conn:       conn,
+		r:          bufio.NewReader(conn),
+		w:          bufio.NewWriterSize(conn, writeBufferSize),
+		partial:    make(map[uint32][]byte),
+		partialMax: maxPartialSize,
+		lanes:      make(map[uint64][]*frameWrite),
+		credits:    windowSize,
+	}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// SetCompressor compresses frames whose payload is not less than threshold bytes with c,
+// and decompresses frames flagged by peer. It should be called before any frame is read or written.
+func (f *FrameConn) SetCompressor(c Compressor, threshold int) {
+	f.compressor, f.threshold = c, threshold
+}
+
+// ReadFrame returns the payload of next frame, chunks are joined.
+// The returned slice is only valid until the next call of ReadFrame.
+func (f *FrameConn) ReadFrame() ([]byte, error) {
+	for {
+		var prefix [framePrefixLen]byte
+		if _, err := io.ReadFull(f.r, prefix[:]); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(prefix[:4])
+		flags := prefix[4]
+		if n > MaxFrameSize {
+			return nil, ErrFrameTooLarge
+		}
+		if cap(f.rbuf) < int(n) {
+			f.rbuf = make([]byte, n)
+		}
+		payload := f.rbuf[:n]
+		if _, err := io.ReadFull(f.r, payload); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if flags&frameWindow != 0 {
+			if n != 4 {
+				return nil, errors.New("rpc codec: malformed window frame")
+			}
+			f.grant(binary.BigEndian.Uint32(payload))
+			continue
+		}
+		f.consume(int64(n))
+		if flags&frameChunk != 0 {
+			if n < 4 {
+				return nil, errors.New("rpc codec: malformed chunk frame")
+			}
+			id := binary.BigEndian.Uint32(payload)
+			frame := append(f.partial[id], payload[4:]...)
+			if len(frame) > MaxFrameSize {
+				return nil, ErrFrameTooLarge
+			}
+			if f.partialLen += int64(n - 4); f.partialLen > f.partialMax {
+				return nil, errors.New("rpc codec: too many bytes of unfinished chunked frames")
+			}
+			if flags&frameMore != 0 {
+				f.partial[id] = frame
+				continue
+			}
+			delete(f.partial, id)
+			f.partialLen -= int64(len(frame))
+			payload = frame
+		}
+		if flags&frameCompressed != 0 {
+			if f.compressor == nil {
+				return nil, errors.New("rpc codec: compressed frame without negotiated compression")
+			}
+			return f.compressor.Decompress(payload)
+		}
+		return payload, nil
+	}
+}
+
+// consume counts n bytes read, and gives the window back to peer every half window
+func (f *FrameConn) consume(n int64) {
+	if f.consumed += n; f.consumed < windowSize/2 {
+		return
+	}
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], uint32(f.consumed))
+	f.consumed = 0
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		f.control = append(f.control, &frameWrite{flags: frameWindow, payload: payload[:]})
+		f.cond.Signal()
+	}
+}
+
+// grant adds the window given back by peer
+func (f *FrameConn) grant(n uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.credits += int64(n)
+	f.cond.Signal()
+}
+
+// WriteFrame queues payload as one frame and waits until it's flushed into conn.
+// h decides the order of the frame in the write queue, it's not written.
+// payload must not be modified until WriteFrame returns.
+func (f *FrameConn) WriteFrame(h *Header, payload []byte) error {
+	return f.WriteFrames([]*Header{h}, [][]byte{payload})
+}
+
+// WriteFrames queues payloads as frames at once, so that they're flushed together,
+// and waits until all of them are flushed. hs[i] is the header of payloads[i].
+func (f *FrameConn) WriteFrames(hs []*Header, payloads [][]byte) error {
+	fws := make([]*frameWrite, len(payloads))
+	for i, payload := range payloads {
+		fw, err := f.newFrameWrite(payload)
+		if err != nil {
+			return err
+		}
+		fws[i] = fw
+	}
+	if err := f.enqueue(hs, fws); err != nil {
+		return err
+	}
+	var err error
+	for _, fw := range fws {
+		if e := <-fw.done; err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// newFrameWrite compresses payload if it helps
+func (f *FrameConn) newFrameWrite(payload []byte) (*frameWrite, error) {
+	var flags uint8
+	if f.compressor != nil && len(payload) >= f.threshold {
+		compressed, err := f.compressor.Compress(payload)
+		if err != nil {
+			return nil, err
+		}
+		// keep the original payload if compression doesn't help
+		if len(compressed) < len(payload) {
+			payload = compressed
+			flags |= frameCompressed
+		}
+	}
+	if len(payload) > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(payload))
+	}
+	return &frameWrite{flags: flags, payload: payload, done: make(chan error, 1)}, nil
+}
+
+// enqueue puts the frames into the write queue, fw.done receives the result once it's flushed
+func (f *FrameConn) enqueue(hs []*Header, fws []*frameWrite) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	for i, fw := range fws {
+		h := hs[i]
+		if isControl(h) {
+			f.control = append(f.control, fw)
+			continue
+		}
+		if len(fw.payload) > chunkSize {
+			if f.nextID++; f.nextID == 0 {
+				f.nextID++ // 0 means not chunked
+			}
+			fw.id = f.nextID
+		}
+		if len(f.lanes[h.Seq]) == 0 {
+			f.ring = append(f.ring, h.Seq)
+		}
+		f.lanes[h.Seq] = append(f.lanes[h.Seq], fw)
+	}
+	f.cond.Signal()
+	return nil
+}
+
+// next pops the next frame or chunk to write, fw is nil if nothing can be written now.
+// last reports whether it's the end of fw.
+func (f *FrameConn) next() (fw *frameWrite, flags uint8, chunk []byte, last bool) {
+	if f.err != nil {
+		return nil, 0, nil, false
+	}
+	if len(f.control) > 0 {
+		fw = f.control[0]
+		f.control[0] = nil
+		f.control = f.control[1:]
+		if fw.flags&frameWindow == 0 {
+			f.credits -= int64(len(fw.payload)) // may be negative, control frames never wait
+		}
+		return fw, fw.flags, fw.payload, true
+	}
+	if len(f.ring) == 0 {
+		return nil, 0, nil, false
+	}
+	seq := f.ring[0]
+	lane := f.lanes[seq]
+	fw = lane[0]
+	n := len(fw.payload)
+	if fw.id != 0 && n > chunkSize {
+		n = chunkSize
+	}
+	cost := int64(n) // the bytes counted by peer, including the ID of a chunk
+	if fw.id != 0 {
+		cost += 4
+	}
+	if f.credits < cost {
+		return nil, 0, nil, false // wait for peer to grant more window
+	}
+	f.credits -= cost
+	chunk, fw.payload = fw.payload[:n], fw.payload[n:]
+	flags, last = fw.flags, len(fw.payload) == 0
+	if fw.id != 0 {
+		flags |= frameChunk
+		if !last {
+			flags |= frameMore
+		}
+	}
+	// rotate the lane to the end, so that lanes take turns by chunk
+	f.ring = f.ring[1:]
+	if last {
+		lane[0] = nil
+		lane = lane[1:]
+	}
+	if len(lane) == 0 {
+		delete(f.lanes, seq)
+	} else {
+		f.lanes[seq] = lane
+		f.ring = append(f.ring, seq)
+	}
+	return fw, flags, chunk, last
+}
+
+// writeLoop writes queued frames into conn, frames are flushed together
+// when nothing more can be written, then their writers are told the result.
+func (f *FrameConn) writeLoop() {
+	var written []*frameWrite // frames written completely but not flushed yet
+	dirty := false            // something is written but not flushed yet
+	for {
+		f.mu.Lock()
+		fw, flags, chunk, last := f.next()
+		for fw == nil && f.err == nil && !dirty {
+			f.cond.Wait()
+			fw, flags, chunk, last = f.next()
+		}
+		err := f.err
+		f.mu.Unlock()
+		// a frame not written completely is still in the queue, fail takes care of it
+		if last && fw.done != nil {
+			written = append(written, fw)
+		}
+		if err == nil && fw == nil {
+			err = f.w.Flush()
+			for _, w := range written {
+				w.done <- err
+			}
+			written, dirty = written[:0], false
+		} else if err == nil {
+			err = f.writeChunk(fw, flags, chunk)
+			dirty = true
+		}
+		if err != nil {
+			f.fail(err, written)
+			return
+		}
+	}
+}
+
+func (f *FrameConn) writeChunk(fw *frameWrite, flags uint8, chunk []byte) error {
+	var prefix [framePrefixLen + 4]byte
+	n := framePrefixLen
+	if flags&frameChunk != 0 {
+		binary.BigEndian.PutUint32(prefix[framePrefixLen:], fw.id)
+		n += 4
+	}
+	binary.BigEndian.PutUint32(prefix[:4], uint32(n-framePrefixLen+len(chunk)))
+	prefix[4] = flags
+	if _, err := f.w.Write(prefix[:n]); err != nil {
+		return err
+	}
+	_, err := f.w.Write(chunk)
+	return err
+}
+
+// fail stops writing, all waiting writers receive err and conn is closed
+func (f *FrameConn) fail(err error, written []*frameWrite) {
+	f.mu.Lock()
+	if f.err == nil {
+		f.err = err
+	}
+	err = f.err
+	waiting := written
+	for _, fw := range f.control {
+		waiting = append(waiting, fw)
+	}
+	for _, lane := range f.lanes {
+		waiting = append(waiting, lane...)
+	}
+	f.control, f.lanes, f.ring = nil, nil, nil
+	f.mu.Unlock()
+	for _, fw := range waiting {
+		if fw.done != nil {
+			fw.done <- err
+		}
+	}
+	_ = f.conn.Close()
+}
+
+// Close close the conn, frames not written yet fail with io.ErrClosedPipe
+func (f *FrameConn) Close() error {
+	f.mu.Lock()
+	if f.err == nil {
+		f.err = io.ErrClosedPipe
+	}
+	f.cond.Broadcast()
+	f.mu.Unlock()
+	return f.conn.Close()
+}
@@ -1,68 +1,86 @@
 package codec
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/gob"
 	"io"
 	"log"
+	"sync"
 )
 
 // GobCodec is the implement of Codec.
+// 每个帧都使用新的 gob 编解码器，帧中携带完整的类型信息，
+// 这样一个坏帧不会影响后续帧的解析。
 type GobCodec struct {
-	// conn 是由构建函数传入，通常是通过 TCP 或者 Unix 建立 socket 时得到的链接实例
-	conn io.ReadWriteCloser
-	// bind with conn
-	buf *bufio.Writer
-	dec *gob.Decoder
-	enc *gob.Encoder
+	frameCodec              // writes the frames encoded by encode
+	rbuf       bytes.Reader // bind the frame being read
+	dec        *gob.Decoder // decoder bind rbuf
+	wmu        sync.Mutex   // protect wbuf, so that Write is safe for concurrent use
+	wbuf       bytes.Buffer // encode header & body into wbuf before writing a frame
 }
 
 // 确保GobCodec实现了所有Codec interface的基类
 var _ Codec = (*GobCodec)(nil)
+var _ RawBodyCodec = (*GobCodec)(nil)
+var _ BatchCodec = (*GobCodec)(nil)
+var _ Compressible = (*GobCodec)(nil)
 
 // NewGobCodec is the constructor func of GobCodec
 func NewGobCodec(conn io.ReadWriteCloser) Codec {
-	buf := bufio.NewWriter(conn)
-	return &GobCodec{
-		conn: conn,                 // 通常是通过 TCP 或者 Unix 建立 socket 时得到的链接实例
-		buf:  buf,                  // buf 是为了防止阻塞而创建的带缓冲的 Writer
-		dec:  gob.NewDecoder(conn), // decoder bind conn
-		enc:  gob.NewEncoder(buf),  // encoder bind buffer ,buffer bind conn
-	}
+	c := new(GobCodec)
+	c.frameCodec = frameCodec{frames: NewFrameConn(conn), encode: c.encode}
+	return c
 }
 
-// ReadHeader decode a Header from *Header with Gob coding
+// ReadHeader read next frame and decode a Header from it with Gob coding
 func (c *GobCodec) ReadHeader(h *Header) error {
+	payload, err := c.frames.ReadFrame()
+	if err != nil {
+		return err
+	}
+	// bytes.Reader is an io.ByteReader, so dec reads exactly the header from it
+	c.rbuf.Reset(payload)
+	c.dec = gob.NewDecoder(&c.rbuf)
 	return c.dec.Decode(h)
 }
 
 // ReadBody decode a body from *body with Gob coding
-// Here body must be pointer.Todo need a assert?
+// Here body must be pointer, nil body discards the rest of the frame.
 func (c *GobCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		return nil
+	}
 	return c.dec.Decode(body)
 }
 
-// Write header and body into conn with gob coding
-func (c *GobCodec) Write(h *Header, body interface{}) (err error) {
-	// flush buffer into conn
-	defer func() {
-		_ = c.buf.Flush()
-		if err != nil {
-			_ = c.Close()
-		}
-	}()
-	if err := c.enc.Encode(h); err != nil {
+// ReadRawBody returns a copy of the rest of the frame
+func (c *GobCodec) ReadRawBody() ([]byte, error) {
+	raw := make([]byte, c.rbuf.Len())
+	_, _ = c.rbuf.Read(raw)
+	return raw, nil
+}
+
+// DecodeBody decodes raw with a new decoder, the body carries its own type information
+func (c *GobCodec) DecodeBody(raw []byte, body interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(raw)).Decode(body)
+}
+
+// encode returns a copy of header and body encoded, the frame is written without holding wmu
+func (c *GobCodec) encode(h *Header, body interface{}) ([]byte, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wbuf.Reset()
+	enc := gob.NewEncoder(&c.wbuf)
+	// encode errors leave the conn untouched, nothing has been written yet
+	if err := enc.Encode(h); err != nil {
 		log.Println("rpc codec: gob error encoding header:", err)
-		return err
+		return nil, err
 	}
-	if err := c.enc.Encode(body); err != nil {
-		log.Println("rpc codec: gob error encoding body:", err)
-		return err
+	if body != nil {
+		if err := enc.Encode(body); err != nil {
+			log.Println("rpc codec: gob error encoding body:", err)
+			return nil, err
+		}
 	}
-	return nil
-}
-
-// Close close the conn
-func (c *GobCodec) Close() error {
-	return c.conn.Close()
+	return append([]byte(nil), c.wbuf.Bytes()...), nil
 }
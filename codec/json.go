@@ -1,68 +1,83 @@
 package codec
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/json"
 	"io"
 	"log"
+	"sync"
 )
 
 // JsonCodec is the implement of Codec.
 type JsonCodec struct {
-	// conn 是由构建函数传入，通常是通过 TCP 或者 Unix 建立 socket 时得到的链接实例
-	conn io.ReadWriteCloser
-	// bind with conn
-	buf *bufio.Writer
-	dec *json.Decoder
-	enc *json.Encoder
+	frameCodec               // writes the frames encoded by encode
+	dec        *json.Decoder // decoder bind the frame being read
+	frame      []byte        // the frame being read
+	wmu        sync.Mutex    // protect wbuf & enc, so that Write is safe for concurrent use
+	wbuf       bytes.Buffer  // encode header & body into wbuf before writing a frame
+	enc        *json.Encoder // encoder bind wbuf
 }
 
 // 确保JsonCodec实现了所有Codec interface的基类
 var _ Codec = (*JsonCodec)(nil)
+var _ RawBodyCodec = (*JsonCodec)(nil)
+var _ BatchCodec = (*JsonCodec)(nil)
+var _ Compressible = (*JsonCodec)(nil)
 
 // NewJsonCodec is the constructor func of JsonCodec
 func NewJsonCodec(conn io.ReadWriteCloser) Codec {
-	buf := bufio.NewWriter(conn)
-	return &JsonCodec{
-		conn: conn,                  // 通常是通过 TCP 或者 Unix 建立 socket 时得到的链接实例
-		buf:  buf,                   // buf 是为了防止阻塞而创建的带缓冲的 Writer
-		dec:  json.NewDecoder(conn), // decoder bind conn
-		enc:  json.NewEncoder(buf),  // encoder bind buffer ,buffer bind conn
-	}
+	c := new(JsonCodec)
+	c.frameCodec = frameCodec{frames: NewFrameConn(conn), encode: c.encode}
+	c.enc = json.NewEncoder(&c.wbuf)
+	return c
 }
 
-// ReadHeader decode a Header from *Header with json coding
+// ReadHeader read next frame and decode a Header from it with json coding
 func (c *JsonCodec) ReadHeader(h *Header) error {
+	payload, err := c.frames.ReadFrame()
+	if err != nil {
+		return err
+	}
+	c.frame = payload
+	c.dec = json.NewDecoder(bytes.NewReader(payload))
 	return c.dec.Decode(h)
 }
 
 // ReadBody decode a body from *body with json coding
-// Here body must be pointer.Todo need a assert?
+// Here body must be pointer, nil body discards the rest of the frame.
 func (c *JsonCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		return nil
+	}
 	return c.dec.Decode(body)
 }
 
-// Write header and body into conn with json coding
-func (c *JsonCodec) Write(h *Header, body interface{}) (err error) {
-	// flush buffer into conn
-	defer func() {
-		_ = c.buf.Flush()
-		if err != nil {
-			_ = c.Close()
-		}
-	}()
+// ReadRawBody returns a copy of the frame after the header,
+// dec buffers ahead so the offset is used instead of the reader
+func (c *JsonCodec) ReadRawBody() ([]byte, error) {
+	return append([]byte(nil), c.frame[c.dec.InputOffset():]...), nil
+}
+
+// DecodeBody decodes raw into body with json coding
+func (c *JsonCodec) DecodeBody(raw []byte, body interface{}) error {
+	return json.Unmarshal(raw, body)
+}
+
+// encode returns a copy of header and body encoded, the frame is written without holding wmu
+func (c *JsonCodec) encode(h *Header, body interface{}) ([]byte, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wbuf.Reset()
+	// encode errors leave the conn untouched, nothing has been written yet
 	if err := c.enc.Encode(h); err != nil {
 		log.Println("rpc codec: json error encoding header:", err)
-		return err
+		return nil, err
 	}
-	if err := c.enc.Encode(body); err != nil {
-		log.Println("rpc codec: json error encoding body:", err)
-		return err
+	if body != nil {
+		if err := c.enc.Encode(body); err != nil {
+			log.Println("rpc codec: json error encoding body:", err)
+			return nil, err
+		}
 	}
-	return nil
-}
-
-// Close close the conn
-func (c *JsonCodec) Close() error {
-	return c.conn.Close()
+	return append([]byte(nil), c.wbuf.Bytes()...), nil
 }
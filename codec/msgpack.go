@@ -0,0 +1,93 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgpackCodec is the implement of Codec.
+// 帧的内容是连续的两个 msgpack 对象 | Header | Body |，
+// Header 按字段名编码为 map，其他语言的实现也能直接解析。
+type MsgpackCodec struct {
+	frameCodec                  // writes the frames encoded by encode
+	rbuf       bytes.Reader     // bind the frame being read
+	dec        *msgpack.Decoder // decoder bind rbuf
+	wmu        sync.Mutex       // protect wbuf & enc, so that Write is safe for concurrent use
+	wbuf       bytes.Buffer     // encode header & body into wbuf before writing a frame
+	enc        *msgpack.Encoder // encoder bind wbuf
+}
+
+// 确保MsgpackCodec实现了所有Codec interface的基类
+var _ Codec = (*MsgpackCodec)(nil)
+var _ RawBodyCodec = (*MsgpackCodec)(nil)
+var _ BatchCodec = (*MsgpackCodec)(nil)
+var _ Compressible = (*MsgpackCodec)(nil)
+
+// NewMsgpackCodec is the constructor func of MsgpackCodec
+func NewMsgpackCodec(conn io.ReadWriteCloser) Codec {
+	c := new(MsgpackCodec)
+	c.frameCodec = frameCodec{frames: NewFrameConn(conn), encode: c.encode}
+	c.dec = msgpack.NewDecoder(&c.rbuf)
+	// decode numbers in interface{} (e.g. map[string]interface{} replies)
+	// as int64/uint64/float64 instead of the smallest msgpack type
+	c.dec.UseLooseInterfaceDecoding(true)
+	c.enc = msgpack.NewEncoder(&c.wbuf)
+	return c
+}
+
+// ReadHeader read next frame and decode a Header from it with msgpack coding
+func (c *MsgpackCodec) ReadHeader(h *Header) error {
+	payload, err := c.frames.ReadFrame()
+	if err != nil {
+		return err
+	}
+	// bytes.Reader is an io.ByteScanner, so dec reads it directly without buffering
+	c.rbuf.Reset(payload)
+	return c.dec.Decode(h)
+}
+
+// ReadBody decode a body from *body with msgpack coding
+// Here body must be pointer, nil body discards the rest of the frame.
+func (c *MsgpackCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	return c.dec.Decode(body)
+}
+
+// ReadRawBody returns a copy of the rest of the frame
+func (c *MsgpackCodec) ReadRawBody() ([]byte, error) {
+	raw := make([]byte, c.rbuf.Len())
+	_, _ = c.rbuf.Read(raw)
+	return raw, nil
+}
+
+// DecodeBody decodes raw into body with msgpack coding
+func (c *MsgpackCodec) DecodeBody(raw []byte, body interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(raw))
+	dec.UseLooseInterfaceDecoding(true)
+	return dec.Decode(body)
+}
+
+// encode returns a copy of header and body encoded, the frame is written without holding wmu
+func (c *MsgpackCodec) encode(h *Header, body interface{}) ([]byte, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wbuf.Reset()
+	// encode errors leave the conn untouched, nothing has been written yet
+	if err := c.enc.Encode(h); err != nil {
+		log.Println("rpc codec: msgpack error encoding header:", err)
+		return nil, err
+	}
+	if body != nil {
+		if err := c.enc.Encode(body); err != nil {
+			log.Println("rpc codec: msgpack error encoding body:", err)
+			return nil, err
+		}
+	}
+	return append([]byte(nil), c.wbuf.Bytes()...), nil
+}
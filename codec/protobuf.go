@@ -0,0 +1,288 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtobufCodec is the implement of Codec.
+// 帧的内容为 | HeaderLen uvarint | Header | Body |，
+// Header 按下面的 message 手工编码，不依赖 protoc 生成的代码：
+//
+//	message Header {
+//		string service_method = 1;
+//		uint64 seq            = 2;
+//		int64  server_id      = 3;
+//		string error          = 4;
+//		uint32 kind           = 5;
+//		int64  timeout        = 6;
+//		map<string, string> meta = 7;
+//		uint32 code           = 8;
+//		map<string, string> details = 9;
+//		uint32 window         = 10;
+//	}
+//
+// Body 必须是 proto.Message，出错的响应不携带 Body。
+type ProtobufCodec struct {
+	frameCodec            // writes the frames encoded by encode
+	body       []byte     // body bytes of the frame being read
+	wmu        sync.Mutex // protect wbuf, so that Write is safe for concurrent use
+	wbuf       []byte     // encode header & body into wbuf before writing a frame
+}
+
+// 确保ProtobufCodec实现了所有Codec interface的基类
+var _ Codec = (*ProtobufCodec)(nil)
+var _ RawBodyCodec = (*ProtobufCodec)(nil)
+var _ BatchCodec = (*ProtobufCodec)(nil)
+var _ Compressible = (*ProtobufCodec)(nil)
+
+// ErrNotProtoMessage is returned when a body is not a proto.Message
+var ErrNotProtoMessage = errors.New("rpc codec: protobuf body must be proto.Message")
+
+const (
+	pbHeaderServiceMethod protowire.Number = 1
+	pbHeaderSeq           protowire.Number = 2
+	pbHeaderServerID      protowire.Number = 3
+	pbHeaderError         protowire.Number = 4
+	pbHeaderKind          protowire.Number = 5
+	pbHeaderTimeout       protowire.Number = 6
+	pbHeaderMeta          protowire.Number = 7
+	pbHeaderCode          protowire.Number = 8
+	pbHeaderDetails       protowire.Number = 9
+	pbHeaderWindow        protowire.Number = 10
+)
+
+// fields of map entry
+const (
+	pbMapKey   protowire.Number = 1
+	pbMapValue protowire.Number = 2
+)
+
+// NewProtobufCodec is the constructor func of ProtobufCodec
+func NewProtobufCodec(conn io.ReadWriteCloser) Codec {
+	c := new(ProtobufCodec)
+	c.frameCodec = frameCodec{frames: NewFrameConn(conn), encode: c.encode}
+	return c
+}
+
+// ReadHeader read next frame and decode a Header from it with protobuf coding
+func (c *ProtobufCodec) ReadHeader(h *Header) error {
+	payload, err := c.frames.ReadFrame()
+	if err != nil {
+		return err
+	}
+	n, m := protowire.ConsumeVarint(payload)
+	if m < 0 || uint64(len(payload)-m) < n {
+		return errors.New("rpc codec: protobuf malformed header length")
+	}
+	c.body = payload[m+int(n):]
+	return unmarshalProtobufHeader(payload[m:m+int(n)], h)
+}
+
+// ReadBody decode a body from *body with protobuf coding
+// Here body must be a proto.Message, nil body discards the rest of the frame.
+func (c *ProtobufCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	msg, ok := body.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%w, got %T", ErrNotProtoMessage, body)
+	}
+	return proto.Unmarshal(c.body, msg)
+}
+
+// ReadRawBody returns a copy of the body bytes
+func (c *ProtobufCodec) ReadRawBody() ([]byte, error) {
+	return append([]byte(nil), c.body...), nil
+}
+
+// DecodeBody decodes raw into body, which must be a proto.Message
+func (c *ProtobufCodec) DecodeBody(raw []byte, body interface{}) error {
+	msg, ok := body.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%w, got %T", ErrNotProtoMessage, body)
+	}
+	return proto.Unmarshal(raw, msg)
+}
+
+// encode returns a copy of header and body encoded, the frame is written without holding wmu
+func (c *ProtobufCodec) encode(h *Header, body interface{}) ([]byte, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	header := marshalProtobufHeader(nil, h)
+	c.wbuf = protowire.AppendVarint(c.wbuf[:0], uint64(len(header)))
+	c.wbuf = append(c.wbuf, header...)
+	// error responses carry no body
+	if h.Error == "" && body != nil {
+		msg, ok := body.(proto.Message)
+		if !ok {
+			err := fmt.Errorf("%w, got %T", ErrNotProtoMessage, body)
+			log.Println("rpc codec: protobuf error encoding body:", err)
+			return nil, err
+		}
+		var err error
+		if c.wbuf, err = (proto.MarshalOptions{}).MarshalAppend(c.wbuf, msg); err != nil {
+			log.Println("rpc codec: protobuf error encoding body:", err)
+			return nil, err
+		}
+	}
+	return append([]byte(nil), c.wbuf...), nil
+}
+
+func marshalProtobufHeader(b []byte, h *Header) []byte {
+	if h.ServiceMethod != "" {
+		b = protowire.AppendTag(b, pbHeaderServiceMethod, protowire.BytesType)
+		b = protowire.AppendString(b, h.ServiceMethod)
+	}
+	if h.Seq != 0 {
+		b = protowire.AppendTag(b, pbHeaderSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, h.Seq)
+	}
+	if h.ServerID != 0 {
+		b = protowire.AppendTag(b, pbHeaderServerID, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.ServerID))
+	}
+	if h.Error != "" {
+		b = protowire.AppendTag(b, pbHeaderError, protowire.BytesType)
+		b = protowire.AppendString(b, h.Error)
+	}
+	if h.Kind != KindCall {
+		b = protowire.AppendTag(b, pbHeaderKind, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Kind))
+	}
+	if h.Timeout != 0 {
+		b = protowire.AppendTag(b, pbHeaderTimeout, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Timeout))
+	}
+	b = appendProtobufMap(b, pbHeaderMeta, h.Meta)
+	if h.Code != 0 {
+		b = protowire.AppendTag(b, pbHeaderCode, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Code))
+	}
+	b = appendProtobufMap(b, pbHeaderDetails, h.Details)
+	if h.Window != 0 {
+		b = protowire.AppendTag(b, pbHeaderWindow, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Window))
+	}
+	return b
+}
+
+// appendProtobufMap encodes map entries as repeated messages of key and value
+func appendProtobufMap(b []byte, num protowire.Number, m map[string]string) []byte {
+	for k, v := range m {
+		var entry []byte
+		entry = protowire.AppendTag(entry, pbMapKey, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, pbMapValue, protowire.BytesType)
+		entry = protowire.AppendString(entry, v)
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+func unmarshalProtobufHeader(b []byte, h *Header) error {
+	*h = Header{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == pbHeaderServiceMethod && typ == protowire.BytesType:
+			var v string
+			v, n = protowire.ConsumeString(b)
+			h.ServiceMethod = v
+		case num == pbHeaderSeq && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Seq = v
+		case num == pbHeaderServerID && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.ServerID = int(v)
+		case num == pbHeaderError && typ == protowire.BytesType:
+			var v string
+			v, n = protowire.ConsumeString(b)
+			h.Error = v
+		case num == pbHeaderKind && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Kind = Kind(v)
+		case num == pbHeaderTimeout && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Timeout = time.Duration(v)
+		case num == pbHeaderMeta && typ == protowire.BytesType:
+			var v []byte
+			if v, n = protowire.ConsumeBytes(b); n >= 0 {
+				if h.Meta == nil {
+					h.Meta = make(map[string]string)
+				}
+				if err := unmarshalProtobufMapEntry(v, h.Meta); err != nil {
+					return err
+				}
+			}
+		case num == pbHeaderCode && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Code = uint32(v)
+		case num == pbHeaderDetails && typ == protowire.BytesType:
+			var v []byte
+			if v, n = protowire.ConsumeBytes(b); n >= 0 {
+				if h.Details == nil {
+					h.Details = make(map[string]string)
+				}
+				if err := unmarshalProtobufMapEntry(v, h.Details); err != nil {
+					return err
+				}
+			}
+		case num == pbHeaderWindow && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Window = uint32(v)
+		default:
+			// skip unknown fields for forward compatibility
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func unmarshalProtobufMapEntry(b []byte, m map[string]string) error {
+	var key, value string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == pbMapKey && typ == protowire.BytesType:
+			key, n = protowire.ConsumeString(b)
+		case num == pbMapValue && typ == protowire.BytesType:
+			value, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	m[key] = value
+	return nil
+}
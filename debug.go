@@ -4,21 +4,52 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"sort"
 )
 
 const debugText = `<html>
 	<body>
 	<title>YaRPC Services</title>
-	{{range .}}
+	{{range .Services}}
 	<hr>
 	Service {{.Name}}
 	<hr>
 		<table>
-		<th align=center>Method</th><th align=center>Calls</th>
+		<th align=center>Method</th><th align=center>Calls</th><th align=center>Panics</th>
 		{{range $name, $mtype := .Method}}
 			<tr>
-			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
+			<td align=left font=fixed>{{$name}}({{if $mtype.WithContext}}context.Context, {{end}}{{with $mtype.ArgType}}{{.}}, {{end}}{{$mtype.ReplyType}}) error</td>
 			<td align=center>{{$mtype.NumCalls}}</td>
+			<td align=center>{{$mtype.NumPanics}}</td>
+			</tr>
+		{{end}}
+		</table>
+	{{end}}
+	<hr>
+	Connections
+	<hr>
+		<table>
+		<th align=center>Remote</th><th align=center>Codec</th><th align=center>Compression</th>
+		{{range .Conns}}
+			<tr>
+			<td align=left font=fixed>{{.Remote}}</td>
+			<td align=center>{{.CodecType}}</td>
+			<td align=center>{{if .Compress}}{{.Compress}}{{else}}none{{end}}</td>
+			</tr>
+		{{end}}
+		</table>
+	{{if .Limits}}
+	<hr>
+	Limits
+	<hr>
+		<table>
+		<th align=center>Scope</th><th align=center>Active</th><th align=center>Limit</th><th align=center>Rejected</th>
+		{{range .Limits}}
+			<tr>
+			<td align=left font=fixed>{{.Scope}}</td>
+			<td align=center>{{.Active}}</td>
+			<td align=center>{{.Limit}}</td>
+			<td align=center>{{.Rejected}}</td>
 			</tr>
 		{{end}}
 		</table>
@@ -37,6 +68,12 @@ type debugService struct {
 	Method map[string]*methodType
 }
 
+type debugData struct {
+	Services []debugService
+	Conns    []*connState
+	Limits   []*semaphore
+}
+
 // Runs at /debug/yarpc
 func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// Build a sorted version of the data.
@@ -49,8 +86,43 @@ func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		})
 		return true
 	})
-	err := debug.Execute(w, services)
+	var conns []*connState
+	server.conns.Range(func(statei, _ interface{}) bool {
+		conns = append(conns, statei.(*connState))
+		return true
+	})
+	err := debug.Execute(w, debugData{Services: services, Conns: conns, Limits: server.limitsInUse(conns)})
 	if err != nil {
 		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
 	}
 }
+
+// limitsInUse lists the semaphores of the server, its methods and conns
+func (server debugHTTP) limitsInUse(conns []*connState) []*semaphore {
+	server.mu.RLock()
+	l := server.limits
+	server.mu.RUnlock()
+	if l == nil {
+		return nil
+	}
+	var sems []*semaphore
+	for _, sem := range []*semaphore{l.server, l.queue} {
+		if sem != nil {
+			sems = append(sems, sem)
+		}
+	}
+	methods := make([]string, 0, len(l.methods))
+	for serviceMethod := range l.methods {
+		methods = append(methods, serviceMethod)
+	}
+	sort.Strings(methods)
+	for _, serviceMethod := range methods {
+		sems = append(sems, l.methods[serviceMethod])
+	}
+	for _, state := range conns {
+		if state.limit != nil {
+			sems = append(sems, state.limit)
+		}
+	}
+	return sems
+}
@@ -0,0 +1,146 @@
+package yarpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"yarpc/codec"
+)
+
+// 错误模型
+// 服务端返回的错误除了 Header.Error 中的描述外，还携带状态码 Header.Code 和可选的 Header.Details，
+// 客户端据此还原出 *Error，调用方可以通过 ErrorCode 区分“方法不存在”、“处理超时”、
+// “连接不可用”等情况，而不需要匹配错误字符串。
+// 服务方法可以直接返回 *Error 来指定状态码，其他错误一律视为 Unknown。
+
+// Code is the status code of a failed call, values follow the gRPC codes
+type Code uint32
+
+const (
+	OK                 Code = iota // not an error
+	Canceled                       // the call was cancelled by caller
+	Unknown                        // error returned by service method without a code
+	InvalidArgument                // malformed request or argument
+	DeadlineExceeded               // the call didn't complete before deadline
+	NotFound                       // service or method not found
+	AlreadyExists                  // entity already exists
+	PermissionDenied               // caller has no permission
+	ResourceExhausted              // server is out of some resource, e.g. concurrency limit
+	FailedPrecondition             // system is not in a state required by the call
+	Aborted                        // the call was aborted
+	OutOfRange                     // argument is out of valid range
+	Unimplemented                  // the call is not supported by server
+	Internal                       // server internal error, e.g. panic
+	Unavailable                    // connection is not available, the call may be retried
+	DataLoss                       // unrecoverable data loss
+	Unauthenticated                // caller is not authenticated
+)
+
+var codeNames = [...]string{
+	"OK", "Canceled", "Unknown", "InvalidArgument", "DeadlineExceeded", "NotFound",
+	"AlreadyExists", "PermissionDenied", "ResourceExhausted", "FailedPrecondition",
+	"Aborted", "OutOfRange", "Unimplemented", "Internal", "Unavailable", "DataLoss",
+	"Unauthenticated",
+}
+
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return fmt.Sprintf("Code(%d)", uint32(c))
+}
+
+// Error is an error with status code which travels across the wire
+type Error struct {
+	Code    Code
+	Message string
+	Details map[string]string // optional details, e.g. service method of a panic
+	cause   error             // local error converted into Error, not sent
+}
+
+// Error returns the message only, so that it reads the same as before codes were introduced
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the local error converted into e
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// NewError returns an *Error with code and message
+func NewError(code Code, msg string) *Error {
+	return &Error{Code: code, Message: msg}
+}
+
+// Errorf returns an *Error with code and formatted message
+func Errorf(code Code, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// WithDetails returns a copy of e with details added
+func (e *Error) WithDetails(kv map[string]string) *Error {
+	out := *e
+	out.Details = make(map[string]string, len(e.Details)+len(kv))
+	for k, v := range e.Details {
+		out.Details[k] = v
+	}
+	for k, v := range kv {
+		out.Details[k] = v
+	}
+	return &out
+}
+
+// wrapError converts err into an *Error with code, keeping err as cause
+func wrapError(code Code, err error) *Error {
+	return &Error{Code: code, Message: err.Error(), cause: err}
+}
+
+// AsError converts err into *Error, nil is returned for nil error.
+// Errors without a code are reported as Unknown,
+// except the context errors and *PanicError.
+func AsError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	var pe *PanicError
+	if errors.As(err, &pe) {
+		return wrapError(Internal, err).WithDetails(map[string]string{"service_method": pe.ServiceMethod})
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return wrapError(DeadlineExceeded, err)
+	case errors.Is(err, context.Canceled):
+		return wrapError(Canceled, err)
+	}
+	return wrapError(Unknown, err)
+}
+
+// ErrorCode returns the code of err, OK for nil error
+func ErrorCode(err error) Code {
+	if err == nil {
+		return OK
+	}
+	return AsError(err).Code
+}
+
+// setHeaderError fills the error fields of response header h
+func setHeaderError(h *codec.Header, err error) {
+	e := AsError(err)
+	h.Error = e.Message
+	h.Code = uint32(e.Code)
+	h.Details = e.Details
+}
+
+// errorFromHeader rebuilds the error sent by server
+func errorFromHeader(h *codec.Header) *Error {
+	code := Code(h.Code)
+	if code == OK {
+		code = Unknown
+	}
+	return &Error{Code: code, Message: h.Error, Details: h.Details}
+}
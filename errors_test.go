@@ -0,0 +1,67 @@
+package yarpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type Fail int
+
+func (f Fail) Code(code uint32, reply *int) error {
+	return NewError(Code(code), "failed on purpose").WithDetails(map[string]string{"reason": "test"})
+}
+
+func (f Fail) Plain(args int, reply *int) error {
+	return errors.New("plain error")
+}
+
+func TestError_codes(t *testing.T) {
+	server := NewServer(0)
+	_ = server.Register(new(Fail))
+	_ = server.Register(new(Panic))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	_, err = client.Call(context.Background(), "Fail.Missing", 0, &reply)
+	assert.Equal(t, NotFound, ErrorCode(err))
+	_, err = client.Call(context.Background(), "Fail", 0, &reply)
+	assert.Equal(t, InvalidArgument, ErrorCode(err))
+
+	_, err = client.Call(context.Background(), "Fail.Code", uint32(PermissionDenied), &reply)
+	e := AsError(err)
+	assert.Equal(t, PermissionDenied, e.Code)
+	assert.Equal(t, "failed on purpose", e.Error())
+	assert.Equal(t, "test", e.Details["reason"])
+
+	_, err = client.Call(context.Background(), "Fail.Plain", 0, &reply)
+	assert.Equal(t, Unknown, ErrorCode(err))
+	assert.Equal(t, "plain error", err.Error())
+
+	_, err = client.Call(context.Background(), "Panic.Nil", 0, &reply)
+	e = AsError(err)
+	assert.Equal(t, Internal, e.Code)
+	assert.Equal(t, "Panic.Nil", e.Details["service_method"])
+
+	_ = client.Close()
+	_, err = client.Call(context.Background(), "Fail.Plain", 0, &reply)
+	assert.Equal(t, Unavailable, ErrorCode(err))
+	assert.True(t, errors.Is(err, ErrShutdown))
+}
+
+func TestAsError(t *testing.T) {
+	assert.Nil(t, AsError(nil))
+	assert.Equal(t, OK, ErrorCode(nil))
+	assert.Equal(t, DeadlineExceeded, ErrorCode(context.DeadlineExceeded))
+	assert.Equal(t, Canceled, ErrorCode(context.Canceled))
+	assert.Equal(t, "NotFound", NotFound.String())
+	assert.Equal(t, "Code(100)", Code(100).String())
+}
@@ -3,7 +3,11 @@ module yarpc
 go 1.15
 
 require (
+	github.com/golang/snappy v0.0.2
 	github.com/jfeliu007/goplantuml v1.5.2 // indirect
+	github.com/klauspost/compress v1.11.3
 	github.com/spf13/afero v1.4.1 // indirect
 	github.com/stretchr/testify v1.6.1
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	google.golang.org/protobuf v1.25.0
 )
@@ -0,0 +1,195 @@
+package yarpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"yarpc/codec"
+)
+
+// 握手报文
+// 连接建立后，客户端首先发送定长前缀 + 变长 body 的二进制 Option，
+// 服务端用 io.ReadFull 精确读取，不会多读走后续 header/body 的字节。
+// | Magic uint32 | Version uint8 | Length uint16 | Body [Length]byte |
+// Body 的格式为：
+// | Features uint32 | ConnectTimeout int64 | HandleTimeout int64 | CodecLen uint8 | CodecType [CodecLen]byte |
+// | CompressLen uint8 | Compress [CompressLen]byte | CompressThreshold uint32 |
+// 服务端校验后回复一个 ack，告知客户端是否接受本次协商：
+// | Magic uint32 | Version uint8 | Status uint8 | Length uint16 | Body [Length]byte |
+// Status 为 0 时，Body 中是服务端确认的协商结果：
+// | Features uint32 | CompressLen uint8 | Compress [CompressLen]byte |
+// Status 非 0 时，Body 中是被拒绝的原因，连接随后会被服务端关闭。
+
+// ProtocolVersion is the version of the handshake and framing protocol
+const ProtocolVersion uint8 = 4
+
+// Feature is a bit set of optional protocol features negotiated in handshake
+type Feature uint32
+
+// supportedFeatures are features this side understands
+const supportedFeatures Feature = 0
+
+const (
+	handshakeAccept uint8 = iota // option accepted
+	handshakeReject              // option rejected, Body carries the reason
+)
+
+const (
+	optionPrefixLen = 4 + 1 + 2
+	replyPrefixLen  = 4 + 1 + 1 + 2
+	maxTypeLen      = codec.MaxTypeLen // max length of CodecType and Compress
+)
+
+// ErrHandshake is returned when the handshake bytes are malformed
+var ErrHandshake = errors.New("rpc: malformed handshake")
+
+// negotiated is the result of handshake acknowledged by server
+type negotiated struct {
+	Features Feature
+	Compress codec.CompressType
+}
+
+// writeOption encodes opt with the binary handshake format and writes it to w
+func writeOption(w io.Writer, opt *Option) error {
+	if len(opt.CodecType) > maxTypeLen || len(opt.Compress) > maxTypeLen {
+		return fmt.Errorf("rpc: codec type or compress type too long: %s %s", opt.CodecType, opt.Compress)
+	}
+	body := make([]byte, 0, 4+8+8+1+len(opt.CodecType)+1+len(opt.Compress)+4)
+	body = appendUint32(body, uint32(opt.Features))
+	body = appendUint64(body, uint64(opt.ConnectTimeout))
+	body = appendUint64(body, uint64(opt.HandleTimeout))
+	body = appendString8(body, string(opt.CodecType))
+	body = appendString8(body, string(opt.Compress))
+	body = appendUint32(body, uint32(opt.CompressThreshold))
+
+	buf := make([]byte, 0, optionPrefixLen+len(body))
+	buf = appendUint32(buf, uint32(opt.MagicNumber))
+	buf = append(buf, ProtocolVersion)
+	buf = appendUint16(buf, uint16(len(body)))
+	buf = append(buf, body...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readOption reads exactly one handshake from r.
+// version is returned separately so that the server can reject it with a reply,
+// only MagicNumber is set in opt if the magic number or version doesn't match.
+func readOption(r io.Reader) (opt *Option, version uint8, err error) {
+	var prefix [optionPrefixLen]byte
+	if _, err = io.ReadFull(r, prefix[:]); err != nil {
+		return nil, 0, err
+	}
+	opt = &Option{MagicNumber: int(binary.BigEndian.Uint32(prefix[0:4]))}
+	version = prefix[4]
+	// the body layout is only known for the same magic number and version,
+	// so it's left unparsed, and the caller rejects the handshake with a clear reason
+	if opt.MagicNumber != MagicNumber || version != ProtocolVersion {
+		return opt, version, nil
+	}
+	body := make([]byte, binary.BigEndian.Uint16(prefix[5:7]))
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, version, err
+	}
+	if len(body) < 4+8+8 {
+		return opt, version, ErrHandshake
+	}
+	opt.Features = Feature(binary.BigEndian.Uint32(body[0:4]))
+	opt.ConnectTimeout = time.Duration(binary.BigEndian.Uint64(body[4:12]))
+	opt.HandleTimeout = time.Duration(binary.BigEndian.Uint64(body[12:20]))
+	var codecType, compress string
+	body, codecType, err = consumeString8(body[20:])
+	if err != nil {
+		return opt, version, err
+	}
+	opt.CodecType = codec.Type(codecType)
+	if body, compress, err = consumeString8(body); err != nil || len(body) < 4 {
+		return opt, version, ErrHandshake
+	}
+	opt.Compress = codec.CompressType(compress)
+	opt.CompressThreshold = int(binary.BigEndian.Uint32(body[0:4]))
+	return opt, version, nil
+}
+
+// writeHandshakeAccept acknowledges the option sent by client
+func writeHandshakeAccept(w io.Writer, n negotiated) error {
+	body := make([]byte, 0, 4+1+len(n.Compress))
+	body = appendUint32(body, uint32(n.Features))
+	body = appendString8(body, string(n.Compress))
+	return writeHandshakeReply(w, handshakeAccept, body)
+}
+
+// writeHandshakeReject rejects the option sent by client with reason
+func writeHandshakeReject(w io.Writer, reason string) error {
+	if len(reason) > 0xffff {
+		reason = reason[:0xffff]
+	}
+	return writeHandshakeReply(w, handshakeReject, []byte(reason))
+}
+
+func writeHandshakeReply(w io.Writer, status uint8, body []byte) error {
+	buf := make([]byte, 0, replyPrefixLen+len(body))
+	buf = appendUint32(buf, MagicNumber)
+	buf = append(buf, ProtocolVersion, status)
+	buf = appendUint16(buf, uint16(len(body)))
+	buf = append(buf, body...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readHandshakeReply waits for the server's ack.
+// It returns what server accepted, or an error if the option was rejected.
+func readHandshakeReply(r io.Reader) (n negotiated, err error) {
+	var prefix [replyPrefixLen]byte
+	if _, err = io.ReadFull(r, prefix[:]); err != nil {
+		return
+	}
+	if binary.BigEndian.Uint32(prefix[0:4]) != MagicNumber {
+		return n, ErrHandshake
+	}
+	status := prefix[5]
+	body := make([]byte, binary.BigEndian.Uint16(prefix[6:8]))
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+	if status != handshakeAccept {
+		return n, errors.New("rpc client: handshake rejected: " + string(body))
+	}
+	if len(body) < 4 {
+		return n, ErrHandshake
+	}
+	n.Features = Feature(binary.BigEndian.Uint32(body[0:4]))
+	var compress string
+	if _, compress, err = consumeString8(body[4:]); err != nil {
+		return
+	}
+	n.Compress = codec.CompressType(compress)
+	return n, nil
+}
+
+// appendString8 appends s with a uint8 length prefix
+func appendString8(b []byte, s string) []byte {
+	return append(append(b, uint8(len(s))), s...)
+}
+
+// consumeString8 parses a string with a uint8 length prefix and returns the rest of b
+func consumeString8(b []byte) ([]byte, string, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return b, "", ErrHandshake
+	}
+	n := int(b[0])
+	return b[1+n:], string(b[1 : 1+n]), nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
@@ -0,0 +1,64 @@
+package yarpc
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"yarpc/codec"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshake_option(t *testing.T) {
+	var buf bytes.Buffer
+	opt := &Option{
+		MagicNumber:    MagicNumber,
+		CodecType:      codec.JsonType,
+		ConnectTimeout: time.Second,
+		HandleTimeout:  time.Minute,
+		Compress:       codec.CompressSnappy,
+	}
+	_ = writeOption(&buf, opt)
+	// bytes following the option must be left untouched
+	buf.WriteString("next")
+	got, version, err := readOption(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, ProtocolVersion, version)
+	assert.Equal(t, opt, got)
+	assert.Equal(t, "next", buf.String())
+}
+
+func TestHandshake_reject(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	go DefaultServer.ServeConn(srvConn)
+	defer func() { _ = cliConn.Close() }()
+	_ = writeOption(cliConn, &Option{MagicNumber: MagicNumber, CodecType: "application/unknown"})
+	_, err := readHandshakeReply(cliConn)
+	_assert(err != nil && strings.Contains(err.Error(), "invalid codec type"), "expect a codec error")
+}
+
+func TestHandshake_compress(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	go DefaultServer.ServeConn(srvConn)
+	defer func() { _ = cliConn.Close() }()
+	_ = writeOption(cliConn, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, Compress: "lz4"})
+	n, err := readHandshakeReply(cliConn)
+	assert.Nil(t, err)
+	assert.Equal(t, codec.CompressNone, n.Compress, "unsupported compression falls back to none")
+}
+
+func TestHandshake_version(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	go DefaultServer.ServeConn(srvConn)
+	defer func() { _ = cliConn.Close() }()
+	// a future version with a body layout unknown to this server
+	buf := appendUint32(nil, uint32(MagicNumber))
+	buf = append(buf, ProtocolVersion+1)
+	buf = appendUint16(buf, 3)
+	buf = append(buf, 1, 2, 3)
+	go func() { _, _ = cliConn.Write(buf) }()
+	_, err := readHandshakeReply(cliConn)
+	_assert(err != nil && strings.Contains(err.Error(), "unsupported protocol version"), "expect a version error, got %v", err)
+}
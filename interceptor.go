@@ -0,0 +1,92 @@
+package yarpc
+
+import (
+	"context"
+	"reflect"
+	"yarpc/codec"
+)
+
+// 拦截器
+// 服务端在解码出 argv 之后、调用服务方法之前，依次经过通过 Server.Use 注册的拦截器，
+// 拦截器可以在调用前后做日志、鉴权、监控等工作，也可以不调用 handler 直接返回错误。
+// 先注册的拦截器在最外层，即调用顺序为 Use(a, b) => a -> b -> 服务方法。
+// 客户端的拦截器通过 Option.Interceptors 配置，Client.Call、CallWithoutServerID
+// 以及 XClient 对每个服务实例的调用（包括 Broadcast）都会经过它们，顺序与服务端相同。
+// 流式调用（见 stream.go）不经过这些拦截器。
+
+// UnaryServerInfo describes the call seen by server interceptors
+type UnaryServerInfo struct {
+	ServiceMethod string       // format "Service.Method"
+	Header        codec.Header // a copy of request header, Meta is the request metadata
+}
+
+// UnaryHandler invokes the next interceptor or finally the service method
+type UnaryHandler func(ctx context.Context, argv, reply interface{}) error
+
+// UnaryServerInterceptor intercepts a call on server,
+// it may short-circuit the call by returning without invoking handler.
+// argv is the decoded argument and reply is the pointer to be sent back.
+type UnaryServerInterceptor func(ctx context.Context, info *UnaryServerInfo, argv, reply interface{}, handler UnaryHandler) error
+
+// Use appends interceptors to the server's chain,
+// it should be called before serving connections.
+func (server *Server) Use(interceptors ...UnaryServerInterceptor) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	// copy on write, so invoke can read the chain without holding the lock
+	chain := make([]UnaryServerInterceptor, 0, len(server.interceptors)+len(interceptors))
+	chain = append(chain, server.interceptors...)
+	server.interceptors = append(chain, interceptors...)
+}
+
+// invoke calls the service method of req through the interceptor chain,
+// panics in interceptors are recovered like those in service methods.
+func (server *Server) invoke(ctx context.Context, req *request) (err error) {
+	server.mu.RLock()
+	interceptors := server.interceptors
+	server.mu.RUnlock()
+
+	handler := func(ctx context.Context, argv, reply interface{}) error {
+		return req.svc.call(ctx, req.mtype, reflect.ValueOf(argv), reflect.ValueOf(reply))
+	}
+	// streaming methods don't go through unary interceptors
+	if len(interceptors) == 0 || req.mtype.kind != unary {
+		return req.svc.call(ctx, req.mtype, req.argv, req.replyv)
+	}
+	defer req.svc.recoverCall(req.mtype, &err)
+	info := &UnaryServerInfo{ServiceMethod: req.h.ServiceMethod, Header: *req.h}
+	info.Header.Meta = req.meta.Copy()
+	return chainUnaryServer(interceptors, info, handler)(ctx, req.argv.Interface(), req.replyv.Interface())
+}
+
+// chainUnaryServer folds interceptors into one handler, interceptors[0] is the outermost
+func chainUnaryServer(interceptors []UnaryServerInterceptor, info *UnaryServerInfo, final UnaryHandler) UnaryHandler {
+	handler := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, argv, reply interface{}) error {
+			return interceptor(ctx, info, argv, reply, next)
+		}
+	}
+	return handler
+}
+
+// UnaryInvoker sends the call to server, or invokes the next client interceptor
+type UnaryInvoker func(ctx context.Context, serviceMethod string, args, reply interface{}) error
+
+// UnaryClientInterceptor intercepts a call on client,
+// it may retry the call by invoking invoker more than once,
+// or short-circuit the call by returning without invoking it.
+type UnaryClientInterceptor func(ctx context.Context, serviceMethod string, args, reply interface{}, client *Client, invoker UnaryInvoker) error
+
+// chainUnaryClient folds interceptors into one invoker, interceptors[0] is the outermost
+func chainUnaryClient(interceptors []UnaryClientInterceptor, client *Client, final UnaryInvoker) UnaryInvoker {
+	invoker := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+			return interceptor(ctx, serviceMethod, args, reply, client, next)
+		}
+	}
+	return invoker
+}
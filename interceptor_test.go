@@ -0,0 +1,80 @@
+package yarpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_Use(t *testing.T) {
+	var foo Foo
+	server := NewServer(0)
+	_ = server.Register(&foo)
+	var trace []string
+	server.Use(func(ctx context.Context, info *UnaryServerInfo, argv, reply interface{}, handler UnaryHandler) error {
+		trace = append(trace, "outer:"+info.ServiceMethod)
+		return handler(ctx, argv, reply)
+	}, func(ctx context.Context, info *UnaryServerInfo, argv, reply interface{}, handler UnaryHandler) error {
+		if info.Header.Meta["token"] != "secret" {
+			return errors.New("unauthenticated")
+		}
+		err := handler(ctx, argv, reply)
+		trace = append(trace, "inner:"+info.ServiceMethod)
+		*reply.(*int) *= 10
+		return err
+	})
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	_, err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "unauthenticated"), "expect the call to be short-circuited")
+
+	ctx := AppendToOutgoingContext(context.Background(), "token", "secret")
+	_, err = client.Call(ctx, "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	assert.Nil(t, err)
+	assert.Equal(t, 30, reply)
+	assert.Equal(t, []string{"outer:Foo.Sum", "outer:Foo.Sum", "inner:Foo.Sum"}, trace)
+}
+
+func TestClient_interceptors(t *testing.T) {
+	var foo Foo
+	server := NewServer(0)
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	var trace []string
+	client, err := Dial("tcp", l.Addr().String(), &Option{
+		Interceptors: []UnaryClientInterceptor{
+			func(ctx context.Context, serviceMethod string, args, reply interface{}, client *Client, invoker UnaryInvoker) error {
+				trace = append(trace, "outer:"+serviceMethod)
+				return invoker(ctx, serviceMethod, args, reply)
+			},
+			func(ctx context.Context, serviceMethod string, args, reply interface{}, client *Client, invoker UnaryInvoker) error {
+				trace = append(trace, "inner:"+serviceMethod)
+				if serviceMethod == "Foo.Blocked" {
+					return errors.New("blocked by interceptor")
+				}
+				return invoker(ctx, serviceMethod, args, reply)
+			},
+		},
+	})
+	assert.Nil(t, err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	assert.Nil(t, client.CallWithoutServerID(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply))
+	assert.Equal(t, 3, reply)
+	_, err = client.Call(context.Background(), "Foo.Blocked", Args{}, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "blocked by interceptor"), "expect the call to be short-circuited")
+	assert.Equal(t, []string{"outer:Foo.Sum", "inner:Foo.Sum", "outer:Foo.Blocked", "inner:Foo.Blocked"}, trace)
+}
@@ -0,0 +1,174 @@
+package yarpc
+
+import (
+	"sync/atomic"
+	"time"
+	"yarpc/codec"
+)
+
+// 心跳与空闲连接
+// 对端没有发送 FIN 就消失时（断电、网络分区），读操作会一直阻塞，连接看起来仍然可用。
+// 客户端通过 Option.KeepaliveInterval 开启心跳：超过 KeepaliveInterval 没有收到任何消息时，
+// 发送 ping（Header.Kind 为 codec.KindPing），对端收到后立即回复 pong（codec.KindPong）；
+// 之后 KeepaliveTimeout 内仍没有收到任何消息，就认为连接已断开：
+// 客户端被标记为 shutdown，未完成的调用以 Unavailable 失败，随后关闭连接，
+// IsAvailable 返回 false，XClient 会重新建立连接。
+// 收到的任何消息都说明对端存活，因此繁忙的连接上不会发送 ping。
+// 服务端通过 Server.SetKeepalive 以同样的方式探测断开的客户端并关闭连接，
+// 还可以关闭超过 IdleTimeout 没有请求的空闲连接：先发送 GOAWAY，再关闭连接。
+
+// Keepalive configures how a server detects dead and idle connections, 0 disables each of them
+type Keepalive struct {
+	Interval    time.Duration // ping client after nothing is received for Interval
+	Timeout     time.Duration // the connection is dead if nothing is received within Timeout after ping, 0 means Interval
+	IdleTimeout time.Duration // close the connection after no request is being handled for IdleTimeout
+}
+
+// SetKeepalive sets how the server detects dead and idle connections,
+// it should be called before serving connections.
+func (server *Server) SetKeepalive(k Keepalive) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.keepalive = k
+}
+
+// errKeepaliveTimeout fails pending calls when server doesn't answer ping
+var errKeepaliveTimeout = NewError(Unavailable, "rpc client: keepalive ping timeout")
+
+// heartbeat detects a dead peer by pinging it when the connection is quiet,
+// a nil heartbeat does nothing.
+type heartbeat struct {
+	interval, timeout time.Duration
+	last              int64         // unix nano of the last message received, atomic
+	received          chan struct{} // signaled when a message is received
+	stop              chan struct{}
+	ping              func() error
+	dead              func()
+}
+
+// newHeartbeat starts pinging the peer, nil is returned if interval is not positive.
+// dead is called if the peer doesn't answer within timeout.
+func newHeartbeat(interval, timeout time.Duration, ping func() error, dead func()) *heartbeat {
+	if interval <= 0 {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = interval
+	}
+	hb := &heartbeat{
+		interval: interval,
+		timeout:  timeout,
+		last:     time.Now().UnixNano(),
+		received: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		ping:     ping,
+		dead:     dead,
+	}
+	go hb.run()
+	return hb
+}
+
+// alive is called whenever a message is received from the peer
+func (hb *heartbeat) alive() {
+	if hb == nil {
+		return
+	}
+	atomic.StoreInt64(&hb.last, time.Now().UnixNano())
+	select {
+	case hb.received <- struct{}{}:
+	default:
+	}
+}
+
+// close stops pinging, it's called once the connection can't be read any more
+func (hb *heartbeat) close() {
+	if hb != nil {
+		close(hb.stop)
+	}
+}
+
+func (hb *heartbeat) run() {
+	timer := time.NewTimer(hb.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-hb.stop:
+			return
+		case <-timer.C:
+		}
+		if quiet := time.Since(time.Unix(0, atomic.LoadInt64(&hb.last))); quiet < hb.interval {
+			timer.Reset(hb.interval - quiet)
+			continue
+		}
+		// drop the signal of messages received before ping
+		select {
+		case <-hb.received:
+		default:
+		}
+		// the write may block on a dead connection, so it's not waited for
+		go func() { _ = hb.ping() }()
+		timer.Reset(hb.timeout)
+		select {
+		case <-hb.stop:
+			return
+		case <-hb.received:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(hb.interval)
+		case <-timer.C:
+			hb.dead()
+			return
+		}
+	}
+}
+
+// pong answers ping of the peer, it's written asynchronously so that reading never waits for writing
+func pong(cc codec.Codec) {
+	go func() { _ = cc.Write(&codec.Header{Kind: codec.KindPong}, nil) }()
+}
+
+// startKeepalive starts detecting dead and idle connection according to server's Keepalive,
+// the returned heartbeat should be told of every message received.
+func (server *Server) startKeepalive(state *connState, calls *inflight, stop <-chan struct{}) *heartbeat {
+	server.mu.RLock()
+	k := server.keepalive
+	server.mu.RUnlock()
+	if k.IdleTimeout > 0 {
+		go state.closeWhenIdle(k.IdleTimeout, calls, stop)
+	}
+	ping := func() error { return state.cc.Write(&codec.Header{Kind: codec.KindPing}, nil) }
+	return newHeartbeat(k.Interval, k.Timeout, ping, func() { _ = state.cc.Close() })
+}
+
+// closeWhenIdle sends GOAWAY and closes the connection after no request is handled for timeout
+func (state *connState) closeWhenIdle(timeout time.Duration, calls *inflight, stop <-chan struct{}) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+		if calls.len() > 0 {
+			timer.Reset(timeout)
+			continue
+		}
+		if idle := time.Since(time.Unix(0, atomic.LoadInt64(&state.lastRequest))); idle < timeout {
+			timer.Reset(timeout - idle)
+			continue
+		}
+		// requests arriving after GOAWAY are answered with Unavailable,
+		// the ones before it are waited for
+		sent := state.goAway()
+		state.wg.Wait()
+		// give GOAWAY a chance to arrive before the connection is closed
+		select {
+		case <-sent:
+		case <-time.After(timeout):
+		}
+		_ = state.cc.Close()
+		return
+	}
+}
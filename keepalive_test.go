@@ -0,0 +1,92 @@
+package yarpc
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startSilentServer accepts the handshake and then never answers, like a server that has vanished
+func startSilentServer(t *testing.T) string {
+	l, err := net.Listen("tcp", ":0")
+	assert.Nil(t, err)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		_, _, _ = readOption(conn)
+		_ = writeHandshakeAccept(conn, negotiated{})
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}()
+	return l.Addr().String()
+}
+
+func TestClient_keepalive(t *testing.T) {
+	t.Run("dead server", func(t *testing.T) {
+		opt := &Option{MagicNumber: MagicNumber, KeepaliveInterval: 50 * time.Millisecond}
+		client, err := Dial("tcp", startSilentServer(t), opt)
+		assert.Nil(t, err)
+		defer func() { _ = client.Close() }()
+		var reply int
+		_, err = client.Call(context.Background(), "Slow.Sleep", time.Second, &reply)
+		assert.Equal(t, Unavailable, ErrorCode(err), "pending call should fail once ping times out")
+		assert.Equal(t, errKeepaliveTimeout, err)
+		assert.False(t, client.IsAvailable())
+	})
+	t.Run("alive server", func(t *testing.T) {
+		server, addr, _ := startSlowServer(t)
+		defer func() { _ = server.Shutdown(context.Background()) }()
+		opt := &Option{MagicNumber: MagicNumber, KeepaliveInterval: 20 * time.Millisecond}
+		client, err := Dial("tcp", addr, opt)
+		assert.Nil(t, err)
+		defer func() { _ = client.Close() }()
+		var reply int
+		_, err = client.Call(context.Background(), "Slow.Sleep", 200*time.Millisecond, &reply)
+		assert.Nil(t, err, "server should answer pings while handling the call")
+		assert.True(t, client.IsAvailable())
+	})
+}
+
+func TestServer_SetKeepalive(t *testing.T) {
+	t.Run("dead client", func(t *testing.T) {
+		server, addr, _ := startSlowServer(t)
+		defer func() { _ = server.Shutdown(context.Background()) }()
+		server.SetKeepalive(Keepalive{Interval: 50 * time.Millisecond})
+		conn, err := net.Dial("tcp", addr)
+		assert.Nil(t, err)
+		defer func() { _ = conn.Close() }()
+		assert.Nil(t, writeOption(conn, DefaultOption))
+		_, err = readHandshakeReply(conn)
+		assert.Nil(t, err)
+		// pings are never answered, so server closes the connection
+		done := make(chan struct{})
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, conn)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("server should close the dead connection")
+		}
+	})
+	t.Run("idle client", func(t *testing.T) {
+		server, addr, _ := startSlowServer(t)
+		defer func() { _ = server.Shutdown(context.Background()) }()
+		server.SetKeepalive(Keepalive{IdleTimeout: 100 * time.Millisecond})
+		client, err := Dial("tcp", addr)
+		assert.Nil(t, err)
+		defer func() { _ = client.Close() }()
+		var reply int
+		_, err = client.Call(context.Background(), "Slow.Sleep", 150*time.Millisecond, &reply)
+		assert.Nil(t, err, "connection with a request being handled is not idle")
+		time.Sleep(300 * time.Millisecond)
+		assert.False(t, client.IsAvailable(), "idle connection should be closed")
+	})
+}
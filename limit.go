@@ -0,0 +1,178 @@
+package yarpc
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// 并发限制
+// 默认情况下服务端为每个请求启动一个协程，一个客户端的突发请求就可能耗尽内存。
+// 通过 Server.SetLimits 可以分别限制整个服务端、每个连接、每个方法同时处理的请求数，
+// 请求需要依次获得连接、方法、服务端三个级别的名额，名额不足时进入有界的等待队列，
+// 队列也满了则立即返回 ResourceExhausted 错误，不会为其启动协程。
+// 排队的请求同样受处理超时和客户端 deadline 的约束，超时后按 DeadlineExceeded 返回。
+// 各级限制的使用情况展示在 debug 页面上。
+
+// Limits configures the concurrency limits of a server, 0 means no limit
+type Limits struct {
+	MaxConcurrent     int            // requests handled at the same time by the server
+	MaxConnConcurrent int            // requests handled at the same time on each connection
+	Methods           map[string]int // requests handled at the same time by "Service.Method"
+	// MaxQueue 是名额不足时最多排队等待的请求数，0 表示不排队，直接返回 ResourceExhausted
+	MaxQueue int
+}
+
+// SetLimits sets the concurrency limits of the server,
+// it should be called before serving connections.
+func (server *Server) SetLimits(l Limits) {
+	ls := &limits{
+		Limits:  l,
+		server:  newSemaphore("server", l.MaxConcurrent),
+		queue:   newSemaphore("queue", l.MaxQueue),
+		methods: make(map[string]*semaphore, len(l.Methods)),
+	}
+	for serviceMethod, n := range l.Methods {
+		if sem := newSemaphore("method "+serviceMethod, n); sem != nil {
+			ls.methods[serviceMethod] = sem
+		}
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.limits = ls
+}
+
+// limits is the runtime state of Limits
+type limits struct {
+	Limits
+	server  *semaphore
+	queue   *semaphore // nil if requests are not queued
+	methods map[string]*semaphore
+}
+
+// connLimit returns the semaphore of a new connection, nil if it's not limited
+func (l *limits) connLimit(remote string) *semaphore {
+	if l == nil {
+		return nil
+	}
+	return newSemaphore("connection "+remote, l.MaxConnConcurrent)
+}
+
+// admit acquires the slots of a request without blocking,
+// if any of them is full the request takes a place in the queue instead,
+// ResourceExhausted is returned if the queue is full too.
+func (l *limits) admit(conn *semaphore, serviceMethod string) (*admission, error) {
+	if l == nil {
+		return &admission{}, nil
+	}
+	a := &admission{sems: []*semaphore{conn, l.methods[serviceMethod], l.server}}
+	full := a.tryAcquire()
+	if full == nil {
+		return a, nil
+	}
+	if l.queue == nil || !l.queue.tryAcquire() {
+		atomic.AddUint64(&full.rejected, 1)
+		return nil, Errorf(ResourceExhausted, "rpc server: %s concurrency limit %d reached", full.scope, full.Limit())
+	}
+	a.queue = l.queue
+	return a, nil
+}
+
+// admission holds the slots of a request under the limits
+type admission struct {
+	sems  []*semaphore // acquired in order, nil ones mean no limit
+	queue *semaphore   // the queue slot held by a waiting request
+}
+
+// tryAcquire acquires all slots or none of them, the full semaphore is returned on failure
+func (a *admission) tryAcquire() *semaphore {
+	for i, sem := range a.sems {
+		if !sem.tryAcquire() {
+			a.releaseN(i)
+			return sem
+		}
+	}
+	return nil
+}
+
+// wait blocks until a queued request gets all slots, it returns at once if not queued
+func (a *admission) wait(ctx context.Context) error {
+	if a.queue == nil {
+		return nil
+	}
+	defer a.queue.release()
+	for i, sem := range a.sems {
+		if err := sem.acquire(ctx); err != nil {
+			a.releaseN(i)
+			return err
+		}
+	}
+	return nil
+}
+
+// release gives back all slots, it must be called once the request is handled
+func (a *admission) release() {
+	a.releaseN(len(a.sems))
+}
+
+func (a *admission) releaseN(n int) {
+	for _, sem := range a.sems[:n] {
+		sem.release()
+	}
+}
+
+// semaphore limits the number of requests handled at the same time,
+// a nil semaphore means no limit.
+type semaphore struct {
+	scope    string
+	slots    chan struct{}
+	rejected uint64
+}
+
+func newSemaphore(scope string, n int) *semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return &semaphore{scope: scope, slots: make(chan struct{}, n)}
+}
+
+// Scope returns what the semaphore limits
+func (s *semaphore) Scope() string { return s.scope }
+
+// Limit returns the number of slots
+func (s *semaphore) Limit() int { return cap(s.slots) }
+
+// Active returns the number of slots in use
+func (s *semaphore) Active() int { return len(s.slots) }
+
+// Rejected returns the number of requests rejected because of the semaphore atomic
+func (s *semaphore) Rejected() uint64 { return atomic.LoadUint64(&s.rejected) }
+
+func (s *semaphore) tryAcquire() bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *semaphore) release() {
+	if s != nil {
+		<-s.slots
+	}
+}
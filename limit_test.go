@@ -0,0 +1,71 @@
+package yarpc
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startLimitedServer(t *testing.T, l Limits) (*Server, *Client) {
+	server := NewServer(0)
+	_ = server.Register(new(Slow))
+	_ = server.Register(new(Foo))
+	server.SetLimits(l)
+	lis, _ := net.Listen("tcp", ":0")
+	go server.Accept(lis)
+	client, err := Dial("tcp", lis.Addr().String())
+	assert.Nil(t, err)
+	return server, client
+}
+
+func TestServer_SetLimits(t *testing.T) {
+	t.Run("queue", func(t *testing.T) {
+		_, client := startLimitedServer(t, Limits{MaxConcurrent: 1, MaxQueue: 1})
+		defer func() { _ = client.Close() }()
+		var replies [3]int
+		calls := make([]*Call, 3)
+		for i := range calls {
+			calls[i] = client.Go("Slow.Sleep", 100*time.Millisecond, &replies[i], nil)
+			time.Sleep(10 * time.Millisecond)
+		}
+		// the first one is handled, the second one is queued and the third one is rejected
+		assert.Nil(t, (<-calls[0].Done).Error)
+		assert.Nil(t, (<-calls[1].Done).Error)
+		assert.Equal(t, ResourceExhausted, ErrorCode((<-calls[2].Done).Error))
+	})
+	t.Run("queue timeout", func(t *testing.T) {
+		_, client := startLimitedServer(t, Limits{MaxConcurrent: 1, MaxQueue: 1})
+		defer func() { _ = client.Close() }()
+		var reply int
+		call := client.Go("Slow.Sleep", 300*time.Millisecond, &reply, nil)
+		time.Sleep(10 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := client.Call(ctx, "Slow.Sleep", time.Duration(0), &reply)
+		assert.Equal(t, DeadlineExceeded, ErrorCode(err))
+		assert.Nil(t, (<-call.Done).Error)
+	})
+	t.Run("method and connection", func(t *testing.T) {
+		server, client := startLimitedServer(t, Limits{MaxConnConcurrent: 2, Methods: map[string]int{"Slow.Sleep": 1}})
+		defer func() { _ = client.Close() }()
+		var reply int
+		call := client.Go("Slow.Sleep", 200*time.Millisecond, &reply, nil)
+		time.Sleep(10 * time.Millisecond)
+		_, err := client.Call(context.Background(), "Slow.Sleep", time.Duration(0), &reply)
+		assert.Equal(t, ResourceExhausted, ErrorCode(err))
+		_assert(strings.Contains(err.Error(), "method Slow.Sleep"), "expect method limit, got %s", err)
+		// other methods are limited by the connection only
+		_, err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		assert.Nil(t, err)
+
+		w := httptest.NewRecorder()
+		debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath, nil))
+		_assert(strings.Contains(w.Body.String(), "method Slow.Sleep"), "expect the limit on debug page")
+		assert.Nil(t, (<-call.Done).Error)
+	})
+}
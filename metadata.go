@@ -0,0 +1,121 @@
+package yarpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// 元数据
+// 请求和响应的 Header 中都可以携带字符串键值对（codec.Header.Meta），
+// 用来传递 trace ID、鉴权 token、租户 ID 等与业务参数无关的信息。
+// 客户端：通过 NewOutgoingContext / AppendToOutgoingContext 把元数据放入 ctx，
+// Client.Call 会把它随请求发送；通过 WithTrailer 接收服务端返回的 trailer。
+// 服务端：接受 context.Context 参数的方法通过 FromIncomingContext 读取请求的元数据，
+// 通过 SetTrailer 设置随响应返回给客户端的 trailer。
+
+// Metadata is the key/value pairs carried by request and response headers
+type Metadata map[string]string
+
+// Copy returns a copy of md
+func (md Metadata) Copy() Metadata {
+	if md == nil {
+		return nil
+	}
+	out := make(Metadata, len(md))
+	for k, v := range md {
+		out[k] = v
+	}
+	return out
+}
+
+type outgoingKey struct{}
+type incomingKey struct{}
+type trailerKey struct{}
+
+// ErrNoIncomingContext is returned by SetTrailer when ctx is not created by server
+var ErrNoIncomingContext = errors.New("rpc: context is not an incoming request context")
+
+// NewOutgoingContext returns a context carrying md, which is sent with calls made with it
+func NewOutgoingContext(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md.Copy())
+}
+
+// AppendToOutgoingContext returns a context with the key/value pairs kv
+// added to its outgoing metadata, kv must be of even length.
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	if len(kv)%2 == 1 {
+		panic("rpc: AppendToOutgoingContext got an odd number of key/value pairs")
+	}
+	md, _ := FromOutgoingContext(ctx)
+	if md == nil {
+		md = make(Metadata, len(kv)/2)
+	}
+	for i := 0; i < len(kv); i += 2 {
+		md[kv[i]] = kv[i+1]
+	}
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// FromOutgoingContext returns a copy of the outgoing metadata in ctx
+func FromOutgoingContext(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(Metadata)
+	return md.Copy(), ok
+}
+
+// incomingMeta is stored in the context passed to handlers
+type incomingMeta struct {
+	md      Metadata
+	mu      sync.Mutex // protect trailer
+	trailer Metadata
+}
+
+func newIncomingContext(ctx context.Context, md Metadata) (context.Context, *incomingMeta) {
+	in := &incomingMeta{md: md}
+	return context.WithValue(ctx, incomingKey{}, in), in
+}
+
+// takeTrailer returns the trailer set by handler
+func (in *incomingMeta) takeTrailer() Metadata {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.trailer.Copy()
+}
+
+// FromIncomingContext returns a copy of the metadata sent by client,
+// ctx must be the one passed to a service method.
+func FromIncomingContext(ctx context.Context) (Metadata, bool) {
+	in, ok := ctx.Value(incomingKey{}).(*incomingMeta)
+	if !ok {
+		return nil, false
+	}
+	return in.md.Copy(), true
+}
+
+// SetTrailer merges md into the trailer sent back with the response,
+// ctx must be the one passed to a service method.
+func SetTrailer(ctx context.Context, md Metadata) error {
+	in, ok := ctx.Value(incomingKey{}).(*incomingMeta)
+	if !ok {
+		return ErrNoIncomingContext
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.trailer == nil {
+		in.trailer = make(Metadata, len(md))
+	}
+	for k, v := range md {
+		in.trailer[k] = v
+	}
+	return nil
+}
+
+// WithTrailer returns a context, the trailer of a call made with it is stored into md
+func WithTrailer(ctx context.Context, md *Metadata) context.Context {
+	return context.WithValue(ctx, trailerKey{}, md)
+}
+
+func trailerFromContext(ctx context.Context) *Metadata {
+	md, _ := ctx.Value(trailerKey{}).(*Metadata)
+	return md
+}
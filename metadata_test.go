@@ -0,0 +1,44 @@
+package yarpc
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type Meta int
+
+func (m Meta) Echo(ctx context.Context, key string, reply *string) error {
+	md, _ := FromIncomingContext(ctx)
+	*reply = md[key]
+	return SetTrailer(ctx, Metadata{"served-by": "meta"})
+}
+
+func TestMetadata(t *testing.T) {
+	var m Meta
+	server := NewServer(0)
+	_ = server.Register(&m)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer func() { _ = client.Close() }()
+
+	var trailer Metadata
+	ctx := NewOutgoingContext(context.Background(), Metadata{"trace-id": "42"})
+	ctx = AppendToOutgoingContext(ctx, "tenant", "yarpc")
+	ctx = WithTrailer(ctx, &trailer)
+	var reply string
+	_, err = client.Call(ctx, "Meta.Echo", "trace-id", &reply)
+	assert.Nil(t, err)
+	assert.Equal(t, "42", reply)
+	assert.Equal(t, Metadata{"served-by": "meta"}, trailer)
+	_, err = client.Call(ctx, "Meta.Echo", "tenant", &reply)
+	assert.Nil(t, err)
+	assert.Equal(t, "yarpc", reply)
+
+	assert.Equal(t, ErrNoIncomingContext, SetTrailer(context.Background(), Metadata{}))
+}
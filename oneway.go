@@ -0,0 +1,51 @@
+package yarpc
+
+import (
+	"context"
+	"yarpc/codec"
+)
+
+// 单向调用
+// Client.Notify 发送 Header.Kind 为 codec.KindOneWay 的请求，写入连接后立即返回，
+// 不在 Client.pending 中登记，也不等待响应。
+// 服务端照常处理（并发限制、超时、拦截器都同样生效），但不回复任何消息，
+// 处理中的错误只记录在服务端日志中，流式方法不能单向调用。
+// 适合审计日志这类不关心结果的通知，调用方无法得知服务端是否处理成功。
+
+// Notify invokes the named function without waiting for the response.
+// It returns once the request is written, a nil error doesn't mean server has handled it.
+// ctx's deadline and metadata are sent with the request like Call.
+func (client *Client) Notify(ctx context.Context, serviceMethod string, args interface{}) error {
+	var invoker UnaryInvoker = func(ctx context.Context, serviceMethod string, args, _ interface{}) error {
+		return client.notify(ctx, serviceMethod, args)
+	}
+	if len(client.opt.Interceptors) > 0 {
+		invoker = chainUnaryClient(client.opt.Interceptors, client, invoker)
+	}
+	return invoker(ctx, serviceMethod, args, nil)
+}
+
+func (client *Client) notify(ctx context.Context, serviceMethod string, args interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return AsError(err)
+	}
+	// the seq is taken without registering a call, no response will come back
+	client.mu.Lock()
+	if err := client.unavailableLocked(); err != nil {
+		client.mu.Unlock()
+		return err
+	}
+	seq := client.seq
+	client.seq++
+	client.mu.Unlock()
+
+	h := &codec.Header{
+		ServiceMethod: serviceMethod,
+		Seq:           seq,
+		Kind:          codec.KindOneWay,
+	}
+	h.Meta, _ = FromOutgoingContext(ctx)
+	deadline, _ := ctx.Deadline()
+	h.Timeout = timeoutOf(deadline)
+	return client.cc.Write(h, args)
+}
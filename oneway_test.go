@@ -0,0 +1,59 @@
+package yarpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type Audit chan string
+
+func (a Audit) Log(entry string, reply *int) error {
+	a <- entry
+	return nil
+}
+
+func (a Audit) Fail(entry string, reply *int) error {
+	return NewError(Internal, "audit failed")
+}
+
+func TestClient_Notify(t *testing.T) {
+	audit := make(Audit, 1)
+	server := NewServer(0)
+	_ = server.Register(audit)
+	_ = server.Register(new(Counter))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer func() { _ = client.Close() }()
+	ctx := context.Background()
+
+	assert.Nil(t, client.Notify(ctx, "Audit.Log", "login"))
+	select {
+	case entry := <-audit:
+		assert.Equal(t, "login", entry)
+	case <-time.After(time.Second):
+		t.Fatal("one-way call should be handled")
+	}
+	// errors and streaming methods are not answered either, the connection keeps working
+	assert.Nil(t, client.Notify(ctx, "Audit.Fail", "login"))
+	assert.Nil(t, client.Notify(ctx, "Counter.Count", 3))
+	var reply int
+	_, err = client.Call(ctx, "Audit.Log", "logout", &reply)
+	assert.Nil(t, err)
+	assert.Equal(t, "logout", <-audit)
+
+	client.mu.Lock()
+	assert.Empty(t, client.pending, "one-way calls should not be pending")
+	client.mu.Unlock()
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Equal(t, Canceled, ErrorCode(client.Notify(cancelled, "Audit.Log", "login")))
+	_ = client.Close()
+	assert.Equal(t, ErrShutdown, client.Notify(ctx, "Audit.Log", "login"))
+}
@@ -0,0 +1,260 @@
+package yarpc
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 自动重连
+// Client 与一条连接绑定，连接断开（terminateCalls 将 shutdown 置为 true）后就永久不可用。
+// ReconnectClient 是可选的重连客户端：连接断开或收到 GOAWAY 后，按指数退避加随机抖动重新拨号同一地址，
+// 并重新完成 Option 握手。连接状态依次在 StateConnecting、StateReady、StateTransientFailure 之间转换，
+// Close 之后进入 StateShutdown，状态的变化可以通过 WaitForStateChange 观察。
+// 调用在连接未就绪时会等待，直到连接就绪或者 ctx 结束；
+// 已经发出的调用随旧连接一起失败，不会自动重试，收到 GOAWAY 时旧连接上的调用仍会得到响应。
+
+// ConnectivityState is the connectivity state of a ReconnectClient
+type ConnectivityState int
+
+const (
+	// StateConnecting means the client is dialing and doing handshake
+	StateConnecting ConnectivityState = iota
+	// StateReady means calls can be sent
+	StateReady
+	// StateTransientFailure means the last dial failed, the client is waiting to retry
+	StateTransientFailure
+	// StateShutdown means the client is closed
+	StateShutdown
+)
+
+func (s ConnectivityState) String() string {
+	switch s {
+	case StateConnecting:
+		return "CONNECTING"
+	case StateReady:
+		return "READY"
+	case StateTransientFailure:
+		return "TRANSIENT_FAILURE"
+	case StateShutdown:
+		return "SHUTDOWN"
+	default:
+		return "INVALID_STATE"
+	}
+}
+
+// Backoff configures the delay between reconnection attempts,
+// the n-th retry waits BaseDelay * Multiplier^n, which is at most MaxDelay
+// and randomized by ±Jitter of itself.
+// BaseDelay, MaxDelay and Multiplier that are not positive are taken from DefaultBackoff.
+type Backoff struct {
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+// DefaultBackoff is used when Option.Backoff is nil
+var DefaultBackoff = Backoff{
+	BaseDelay:  time.Second,
+	MaxDelay:   2 * time.Minute,
+	Multiplier: 1.6,
+	Jitter:     0.2,
+}
+
+// Delay returns how long to wait before the retry after n failed attempts
+func (b Backoff) Delay(n int) time.Duration {
+	if b.BaseDelay <= 0 {
+		b.BaseDelay = DefaultBackoff.BaseDelay
+	}
+	if b.MaxDelay <= 0 {
+		b.MaxDelay = DefaultBackoff.MaxDelay
+	}
+	if b.Multiplier <= 0 {
+		b.Multiplier = DefaultBackoff.Multiplier
+	}
+	d := float64(b.BaseDelay) * math.Pow(b.Multiplier, float64(n))
+	if max := float64(b.MaxDelay); d > max {
+		d = max
+	}
+	d *= 1 + b.Jitter*(2*rand.Float64()-1)
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(d)
+}
+
+// ReconnectClient is a client that redials the server whenever the connection is lost.
+// It's safe for concurrent use.
+type ReconnectClient struct {
+	rpcAddr string
+	opt     *Option
+	backoff Backoff
+	closing chan struct{} // closed by Close
+
+	mu      sync.Mutex // protect following
+	state   ConnectivityState
+	client  *Client       // the ready client, nil if state isn't StateReady
+	changed chan struct{} // closed and replaced on every state change
+	err     error         // error of the last dial
+}
+
+// DialReconnect returns a ReconnectClient of rpcAddr (protocol@addr, see XDial),
+// it connects in background, so calls wait until the connection is ready.
+func DialReconnect(rpcAddr string, opts ...*Option) (*ReconnectClient, error) {
+	opt, err := parseOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	rc := &ReconnectClient{
+		rpcAddr: rpcAddr,
+		opt:     opt,
+		backoff: DefaultBackoff,
+		closing: make(chan struct{}),
+		state:   StateConnecting,
+		changed: make(chan struct{}),
+	}
+	if opt.Backoff != nil {
+		rc.backoff = *opt.Backoff
+	}
+	go rc.run()
+	return rc, nil
+}
+
+// run keeps the client connected until Close is called
+func (rc *ReconnectClient) run() {
+	failures := 0
+	for {
+		client, err := XDial(rc.rpcAddr, rc.opt)
+		if err != nil {
+			rc.setState(StateTransientFailure, nil, err)
+			select {
+			case <-time.After(rc.backoff.Delay(failures)):
+			case <-rc.closing:
+				return
+			}
+			failures++
+			rc.setState(StateConnecting, nil, nil)
+			continue
+		}
+		failures = 0
+		if !rc.setState(StateReady, client, nil) {
+			_ = client.Close() // closed while dialing
+			return
+		}
+		select {
+		case <-client.unusable:
+			// calls sent before GOAWAY are still answered on the old client,
+			// it's closed once they're done, so that its connection is released
+			go func(client *Client) {
+				<-client.drained
+				_ = client.Close()
+			}(client)
+			rc.setState(StateConnecting, nil, nil)
+		case <-rc.closing:
+			return
+		}
+	}
+}
+
+// setState changes the state unless the client is closed, false is returned if it's closed
+func (rc *ReconnectClient) setState(state ConnectivityState, client *Client, err error) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.state == StateShutdown {
+		return false
+	}
+	rc.state, rc.client, rc.err = state, client, err
+	close(rc.changed)
+	rc.changed = make(chan struct{})
+	return true
+}
+
+// State returns the current connectivity state
+func (rc *ReconnectClient) State() ConnectivityState {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.state
+}
+
+// WaitForStateChange waits until the state differs from source or ctx ends,
+// it returns false if ctx ends first.
+func (rc *ReconnectClient) WaitForStateChange(ctx context.Context, source ConnectivityState) bool {
+	for {
+		rc.mu.Lock()
+		state, changed := rc.state, rc.changed
+		rc.mu.Unlock()
+		if state != source {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// ready waits until the connection is ready and the client can send calls, or ctx ends
+func (rc *ReconnectClient) ready(ctx context.Context) (*Client, error) {
+	for {
+		rc.mu.Lock()
+		state, client, changed, lastErr := rc.state, rc.client, rc.changed, rc.err
+		rc.mu.Unlock()
+		switch state {
+		case StateReady:
+			// the client may have got GOAWAY before run switches to StateConnecting
+			if client.IsAvailable() {
+				return client, nil
+			}
+		case StateShutdown:
+			return nil, ErrShutdown
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			msg := "rpc client: connection not ready: " + ctx.Err().Error()
+			if lastErr != nil {
+				msg += ", last dial error: " + lastErr.Error()
+			}
+			return nil, &Error{Code: AsError(ctx.Err()).Code, Message: msg, cause: ctx.Err()}
+		}
+	}
+}
+
+// Call invokes the named function once the connection is ready, waits for it to complete,
+// and returns the server ID and its error status.
+func (rc *ReconnectClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) (int, error) {
+	for {
+		client, err := rc.ready(ctx)
+		if err != nil {
+			return 0, err
+		}
+		id, err := client.Call(ctx, serviceMethod, args, reply)
+		// GOAWAY arrived after ready, the call wasn't sent, so it waits for the new connection
+		if !errors.Is(err, ErrGoAway) {
+			return id, err
+		}
+	}
+}
+
+// Close shuts down the client, calls waiting for the connection fail with ErrShutdown.
+func (rc *ReconnectClient) Close() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.state == StateShutdown {
+		return ErrShutdown
+	}
+	client := rc.client
+	rc.state, rc.client = StateShutdown, nil
+	close(rc.changed)
+	rc.changed = make(chan struct{})
+	close(rc.closing)
+	if client != nil {
+		return client.Close()
+	}
+	return nil
+}
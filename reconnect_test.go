@@ -0,0 +1,132 @@
+package yarpc
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff_Delay(t *testing.T) {
+	b := Backoff{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second, Multiplier: 2, Jitter: 0.2}
+	for n, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		d := b.Delay(n)
+		assert.GreaterOrEqual(t, int64(d), int64(float64(want)*0.8))
+		assert.LessOrEqual(t, int64(d), int64(float64(want)*1.2))
+	}
+}
+
+func TestBackoff_DelayDefaults(t *testing.T) {
+	// zero fields are taken from DefaultBackoff, instead of retrying without delay
+	assert.Equal(t, DefaultBackoff.BaseDelay, Backoff{}.Delay(0))
+	assert.Equal(t, time.Duration(float64(DefaultBackoff.BaseDelay)*DefaultBackoff.Multiplier), Backoff{}.Delay(1))
+	assert.Equal(t, DefaultBackoff.MaxDelay, Backoff{BaseDelay: time.Hour}.Delay(0))
+}
+
+// 收到 GOAWAY 之后、状态切换之前，调用不会被发往已经不可用的 Client
+func TestReconnectClient_readyUnavailable(t *testing.T) {
+	server, addr, _ := startSlowServer(t)
+	defer func() { _ = server.Shutdown(context.Background()) }()
+	old, err := Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer func() { _ = old.Close() }()
+	old.mu.Lock()
+	old.goaway = true
+	old.mu.Unlock()
+	rc := &ReconnectClient{state: StateReady, client: old, changed: make(chan struct{})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = rc.ready(ctx)
+	assert.Equal(t, DeadlineExceeded, ErrorCode(err))
+
+	client, err := Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer func() { _ = client.Close() }()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		rc.setState(StateReady, client, nil)
+	}()
+	var reply int
+	_, err = rc.Call(context.Background(), "Slow.Sleep", time.Duration(0), &reply)
+	assert.Nil(t, err, "call should wait for the new client")
+	assert.Equal(t, 1, reply)
+}
+
+func TestReconnectClient(t *testing.T) {
+	serve := func(addr string) *Server {
+		server := NewServer(0)
+		_ = server.Register(new(Slow))
+		l, err := net.Listen("tcp", addr)
+		assert.Nil(t, err)
+		go server.Accept(l)
+		return server
+	}
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	opt := &Option{Backoff: &Backoff{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond, Multiplier: 1.6, Jitter: 0.2}}
+	rc, err := DialReconnect("tcp@"+addr, opt)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.True(t, rc.WaitForStateChange(ctx, StateConnecting))
+	assert.Equal(t, StateTransientFailure, rc.State(), "no server is listening yet")
+	var reply int
+	_, err = rc.Call(ctx, "Slow.Sleep", time.Duration(0), &reply)
+	assert.Equal(t, DeadlineExceeded, ErrorCode(err), "call should wait for readiness until its deadline")
+
+	server := serve(addr)
+	ctx = context.Background()
+	_, err = rc.Call(ctx, "Slow.Sleep", time.Duration(0), &reply)
+	assert.Nil(t, err, "call should be sent once the connection is ready")
+	assert.Equal(t, StateReady, rc.State())
+
+	// the connection is lost once server shuts down, and comes back with a new server
+	assert.Nil(t, server.Shutdown(ctx))
+	waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	assert.True(t, rc.WaitForStateChange(waitCtx, StateReady))
+	server = serve(addr)
+	defer func() { _ = server.Shutdown(ctx) }()
+	_, err = rc.Call(waitCtx, "Slow.Sleep", time.Duration(0), &reply)
+	assert.Nil(t, err, "client should reconnect to the new server")
+
+	assert.Nil(t, rc.Close())
+	assert.Equal(t, StateShutdown, rc.State())
+	_, err = rc.Call(ctx, "Slow.Sleep", time.Duration(0), &reply)
+	assert.Equal(t, ErrShutdown, err)
+}
+
+// 每次重连后旧的 Client 被关闭，连接和写协程不会泄漏
+func TestReconnectClient_closeOld(t *testing.T) {
+	server, addr, _ := startSlowServer(t)
+	defer func() { _ = server.Shutdown(context.Background()) }()
+	server.SetKeepalive(Keepalive{IdleTimeout: 10 * time.Millisecond})
+	before := runtime.NumGoroutine()
+
+	opt := &Option{Backoff: &Backoff{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Multiplier: 1}}
+	rc, err := DialReconnect("tcp@"+addr, opt)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 20; i++ {
+		var reply int
+		_, err = rc.Call(ctx, "Slow.Sleep", time.Duration(0), &reply)
+		assert.Nil(t, err)
+		// server closes the idle connection, then client reconnects
+		assert.True(t, rc.WaitForStateChange(ctx, StateReady))
+	}
+	assert.Nil(t, rc.Close())
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if runtime.NumGoroutine() <= before+2 {
+			break
+		}
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before+2, "old clients should be closed after reconnecting")
+}
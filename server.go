@@ -1,7 +1,7 @@
 package yarpc
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -11,20 +11,22 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"yarpc/codec"
 )
 
 // 报文设置
-// 一般来说，涉及协议协商的这部分信息，需要设计固定的字节来传输的。
-// 但是为了实现上更简单，yaRPC 客户端固定采用 JSON 编码 Option，
-// 后续的 header 和 body 的编码方式由 Option 中的 CodeType 指定，
-// 服务端首先使用 JSON 解码 Option，然后通过 Option 得 CodeType 解码剩余的内容。
+// 涉及协议协商的这部分信息，使用固定字节的二进制握手传输（见 handshake.go），
+// 服务端按长度精确读取 Option，不会吞掉后续 header/body 的字节，
+// 并回复 ack 告知客户端协商结果，CodecType 不合法时客户端能直接拿到错误。
+// 后续的 header 和 body 的编码方式由 Option 中的 CodeType 指定。
 // 即报文将以这样的形式发送：
 // | Option{MagicNumber: xxx, CodecType: xxx} | Header{ServiceMethod ...} | Body interface{} |
-// | <------      固定 JSON 编码      ------>  | <-------   编码方式由 CodeType 决定   ------->|
-// 在一次连接中，Option 固定在报文的最开始，Header 和 Body 可以有多个，即报文可能是这样的。
-// | Option | Header1 | Body1 | Header2 | Body2 | ...
+// | <------      固定二进制编码      ------>  | <-------   编码方式由 CodeType 决定   ------->|
+// 在一次连接中，Option 固定在报文的最开始，Header 和 Body 可以有多个，
+// 每一对 Header 和 Body 带上长度前缀作为一帧发送（见 codec/frame.go），即报文可能是这样的。
+// | Option | Len1 | Header1 | Body1 | Len2 | Header2 | Body2 | ...
 
 // 超时设置
 // 纵观整个远程调用的过程，需要客户端处理超时的地方有：
@@ -52,6 +54,19 @@ type Option struct {
 	CodecType      codec.Type    // client may choose different Codec to encode body
 	ConnectTimeout time.Duration // 0 means no limit
 	HandleTimeout  time.Duration
+	Features       Feature // optional protocol features requested by client
+	// Compress 指定帧的压缩算法，服务端不支持时协商为不压缩，
+	// CompressThreshold 为压缩阈值，0 表示使用 codec.DefaultCompressThreshold
+	Compress          codec.CompressType
+	CompressThreshold int
+	// Interceptors 是客户端的拦截器链，只在本地生效，不会发送给服务端
+	Interceptors []UnaryClientInterceptor
+	// KeepaliveInterval 是客户端在连接上超过这段时间没有收到消息时发送 ping 的间隔，0 表示不发送，
+	// KeepaliveTimeout 内仍没有收到消息则认为连接已断开，0 表示与 KeepaliveInterval 相同，只在本地生效
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+	// Backoff 是 ReconnectClient 重连的退避策略，nil 表示使用 DefaultBackoff，只在本地生效
+	Backoff *Backoff
 }
 
 // DefaultOption use gob
@@ -63,8 +78,30 @@ var DefaultOption = &Option{
 
 // Server represents an RPC Server.
 type Server struct {
-	serviceMap sync.Map
-	serverID   int
+	serviceMap   sync.Map
+	serverID     int
+	conns        sync.Map     // *connState -> struct{}, connections being served
+	mu           sync.RWMutex // protect following
+	interceptors []UnaryServerInterceptor
+	listeners    map[net.Listener]struct{} // listeners in Accept
+	inShutdown   bool                      // Shutdown has been called
+	limits       *limits                   // concurrency limits, nil means no limit
+	keepalive    Keepalive                 // how dead and idle connections are detected
+}
+
+// connState describes a connection being served, it's shown on the debug page
+type connState struct {
+	Remote    string
+	CodecType codec.Type
+	Compress  codec.CompressType
+
+	cc       codec.Codec
+	wg       *sync.WaitGroup // wait until all request are handled
+	mu       sync.Mutex      // protect draining and adding to wg
+	draining bool            // GOAWAY has been sent, new requests are rejected
+	limit    *semaphore      // concurrency limit of the connection, nil means no limit
+	// lastRequest 是最近一次收到请求的时间（unix nano），用于关闭空闲连接，原子操作
+	lastRequest int64
 }
 
 // NewServer returns a new Server.
@@ -79,10 +116,13 @@ var DefaultServer = NewServer(0)
 // ServeConn blocks, serving the connection until the client hangs up.
 func (server *Server) ServeConn(conn io.ReadWriteCloser) {
 	defer func() { _ = conn.Close() }()
-	var opt Option
-	// decode option by json decoder
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+	// decode option by binary handshake
+	opt, version, err := readOption(conn)
+	if err != nil {
 		log.Println("rpc server: options error: ", err)
+		if err == ErrHandshake {
+			_ = writeHandshakeReject(conn, err.Error())
+		}
 		return
 	}
 	// check magicnumber
@@ -90,15 +130,60 @@ func (server *Server) ServeConn(conn io.ReadWriteCloser) {
 		log.Printf("rpc server: invalid magic number %x", opt.MagicNumber)
 		return
 	}
+	if version != ProtocolVersion {
+		err = fmt.Errorf("unsupported protocol version %d", version)
+		log.Println("rpc server:", err)
+		_ = writeHandshakeReject(conn, err.Error())
+		return
+	}
 	// get corresponding Codec constructor func
 	// different conn may have different option ,so it need different Codec transport as para
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	if f == nil {
-		log.Printf("rpc server: invalid codec type %s", opt.CodecType)
+	f, ok := codec.Lookup(opt.CodecType)
+	if !ok {
+		err = fmt.Errorf("invalid codec type %s, available: %v", opt.CodecType, codec.Types())
+		log.Println("rpc server:", err)
+		_ = writeHandshakeReject(conn, err.Error())
+		return
+	}
+	// negotiate compression, fall back to no compression if it's not supported
+	if opt.Compress != codec.CompressNone {
+		if c, ok := codec.LookupCompressor(opt.Compress); ok {
+			f = codec.WithCompression(f, c, opt.CompressThreshold)
+		} else {
+			log.Printf("rpc server: unsupported compress type %s, fall back to none", opt.Compress)
+			opt.Compress = codec.CompressNone
+		}
+	}
+	if server.shuttingDown() {
+		_ = writeHandshakeReject(conn, errServerShutdown.Error())
+		return
+	}
+	// accept the option and tell client which features are enabled
+	opt.Features &= supportedFeatures
+	if err = writeHandshakeAccept(conn, negotiated{Features: opt.Features, Compress: opt.Compress}); err != nil {
+		log.Println("rpc server: options error: ", err)
 		return
 	}
 	// use f to construct Codec and decoder request
-	server.serveCodec(f(conn), &opt)
+	state := &connState{
+		CodecType: opt.CodecType,
+		Compress:  opt.Compress,
+		cc:        f(conn),
+		wg:        new(sync.WaitGroup),
+		// a new connection counts as a request, so that it isn't closed as idle at once
+		lastRequest: time.Now().UnixNano(),
+	}
+	if nc, ok := conn.(net.Conn); ok {
+		state.Remote = nc.RemoteAddr().String()
+	}
+	server.mu.RLock()
+	state.limit = server.limits.connLimit(state.Remote)
+	server.mu.RUnlock()
+	if !server.trackConn(state) {
+		return // Shutdown is called during handshake
+	}
+	defer server.conns.Delete(state)
+	server.serveCodec(state, opt)
 }
 
 // invalidRequest is a placeholder for response argv when error occurs
@@ -106,38 +191,145 @@ var invalidRequest = struct{}{}
 
 // serverCodec traverse all request :readRequest,handleRequest,sendResponse
 // for to traverse requests until there is no request
+// a request with unknown method or bad body only fails itself,
+// the connection is closed only when the frame itself can't be read
 // handleRequest use go routines
-// sending response one by one guaranteed by mutex sending
+// responses are written concurrently, cc interleaves them by Seq
+// after GOAWAY is sent, new calls are answered with Unavailable without being handled
 // The server can only serialize process requests of the client from conn
 // Todo,whether this serve could process multi client
-func (server *Server) serveCodec(cc codec.Codec, opt *Option) {
-	sending := new(sync.Mutex) // make sure to send a complete response
-	wg := new(sync.WaitGroup)  // wait until all request are handled
+func (server *Server) serveCodec(state *connState, opt *Option) {
+	cc, wg := state.cc, state.wg
+	server.mu.RLock()
+	limits := server.limits
+	server.mu.RUnlock()
+	// ctx is cancelled once the connection can't be read any more,
+	// handlers accepting context.Context can stop their work early
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := newInflight() // requests being handled, so that client can cancel them
+	hb := server.startKeepalive(state, calls, ctx.Done())
 	for {
 		// read request to req
 		req, err := server.readRequest(cc)
+		if req != nil {
+			hb.alive()
+		}
 		if err != nil {
 			if req == nil {
 				break // it's not possible to recover, so close the connection
 			}
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sending)
+			setHeaderError(req.h, err)
+			server.sendResponse(cc, req.h, invalidRequest)
 			continue
 		}
-		wg.Add(1)
+		switch req.h.Kind {
+		case codec.KindCancel:
+			calls.cancel(req.h.Seq)
+			continue
+		case codec.KindPing:
+			pong(cc)
+			continue
+		case codec.KindPong:
+			continue
+		case codec.KindStreamMsg, codec.KindStreamEnd, codec.KindStreamWindow:
+			// messages of a finished stream are dropped
+			if stream := calls.stream(req.h.Seq); stream != nil {
+				stream.receive(req.h)
+			}
+			continue
+		case codec.KindCall, codec.KindOneWay:
+		default:
+			// GOAWAY is only sent by server, and kinds unknown to this version are dropped
+			log.Println("rpc server: drop message of unexpected kind:", req.h.Kind)
+			continue
+		}
+		atomic.StoreInt64(&state.lastRequest, time.Now().UnixNano())
+		if !state.addRequest() {
+			setHeaderError(req.h, errServerShutdown)
+			server.sendResponse(cc, req.h, invalidRequest)
+			continue
+		}
+		// over the limits, the request is rejected without starting a goroutine
+		if req.admission, err = limits.admit(state.limit, req.h.ServiceMethod); err != nil {
+			wg.Done()
+			setHeaderError(req.h, err)
+			server.sendResponse(cc, req.h, invalidRequest)
+			continue
+		}
+		if req.mtype.kind != unary {
+			req.stream = newServerStream(cc, req.h.Seq, req.mtype.kind)
+		}
+		reqCtx, cancelReq := context.WithCancel(ctx)
+		calls.add(req.h.Seq, cancelReq, req.stream)
 
-		go server.handleRequest(cc, req, sending, wg, opt.HandleTimeout)
+		go func(req *request) {
+			defer calls.cancel(req.h.Seq) // release the context once it's done
+			server.handleRequest(reqCtx, cc, req, wg, opt.HandleTimeout)
+		}(req)
 	}
+	hb.close()
+	cancel()
 	wg.Wait()
 	_ = cc.Close()
 }
 
+// inflight tracks the cancel funcs and streams of requests being handled on one connection
+type inflight struct {
+	mu      sync.Mutex
+	cancels map[uint64]context.CancelFunc
+	streams map[uint64]*serverStream
+}
+
+func newInflight() *inflight {
+	return &inflight{
+		cancels: make(map[uint64]context.CancelFunc),
+		streams: make(map[uint64]*serverStream),
+	}
+}
+
+// add the request seq, stream is nil for unary calls
+func (f *inflight) add(seq uint64, cancel context.CancelFunc, stream *serverStream) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cancels[seq] = cancel
+	if stream != nil {
+		f.streams[seq] = stream
+	}
+}
+
+// len returns the number of requests being handled
+func (f *inflight) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.cancels)
+}
+
+func (f *inflight) stream(seq uint64) *serverStream {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.streams[seq]
+}
+
+// cancel the request seq, it's a no-op if the request has been done
+func (f *inflight) cancel(seq uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cancel, ok := f.cancels[seq]; ok {
+		cancel()
+		delete(f.cancels, seq)
+	}
+	delete(f.streams, seq)
+}
+
 // request stores all information of a call
 type request struct {
 	h            *codec.Header // header of request
 	argv, replyv reflect.Value // argv and replyv of request reflect.Value ~= interface{}
 	mtype        *methodType
 	svc          *service
+	meta         Metadata      // metadata sent by client
+	admission    *admission    // slots held under the server's limits
+	stream       *serverStream // stream of a streaming method
 }
 
 func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
@@ -158,15 +350,34 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	if err != nil {
 		return nil, err
 	}
+	// h is reused as the response header, which carries trailer instead of request metadata
+	req := &request{h: h, meta: h.Meta}
+	h.Meta = nil
+	// control messages have no body
+	if h.Kind != codec.KindCall && h.Kind != codec.KindOneWay {
+		return req, nil
+	}
 	// find the service by header
 	// make req.argv and req.replyv
-	req := &request{h: h}
 	req.svc, req.mtype, err = server.findService(h.ServiceMethod)
 	if err != nil {
-		return nil, err
+		// the body is still in the frame, it is skipped on next ReadHeader
+		return req, err
+	}
+	if h.Kind == codec.KindOneWay && req.mtype.kind != unary {
+		return req, Errorf(InvalidArgument, "rpc server: streaming method %s can't be called one-way", h.ServiceMethod)
+	}
+	// messages of client streams follow the request, which has no body
+	if req.mtype.kind == bidiStreaming {
+		if _, ok := cc.(codec.RawBodyCodec); !ok {
+			return req, Errorf(Unimplemented, "rpc server: codec %T can't receive stream messages", cc)
+		}
+		return req, nil
 	}
 	req.argv = req.mtype.newArgv()
-	req.replyv = req.mtype.newReplyv()
+	if req.mtype.kind == unary {
+		req.replyv = req.mtype.newReplyv()
+	}
 
 	// make sure that argvi is a pointer,ReadBody need a pointer as parameter
 	// argvi == req.argv or it's address
@@ -177,64 +388,117 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	// read argvs from conn and save in argvi that is req.argv
 	if err = cc.ReadBody(argvi); err != nil {
 		log.Println("rpc server: read argv err:", err)
-		return req, err
+		return req, wrapError(InvalidArgument, err)
 	}
 	return req, nil
 }
 
 // 这里需要确保 sendResponse 仅调用一次，
-// 因此将整个过程拆分为 called 和 sent 两个阶段，在这段代码中只会发生如下两种情况：
+// 处理结果通过带缓冲的 called 信道返回，在这段代码中只会发生如下两种情况：
 // called 信道接收到消息，代表处理没有超时，继续执行 sendResponse。
-// time.After() 先于 called 接收到消息，说明处理已经超时，called 和 sent 都将被阻塞。
-// 在 case <-time.After(timeout) 处调用 sendResponse。
-func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
+// ctx 先于 called 结束，说明处理已经超时、被客户端取消或连接已断开，
+// 超时则在 case <-ctx.Done() 处调用 sendResponse，
+// 接受 context.Context 参数的方法会随 ctx 一起取消，不会在超时后一直运行。
+// 超时时间取 Option.HandleTimeout 和客户端 deadline（Header.Timeout）中较小的一个。
+func (server *Server) handleRequest(ctx context.Context, cc codec.Codec, req *request, wg *sync.WaitGroup, timeout time.Duration) {
 	defer wg.Done()
-	called := make(chan struct{})
-	sent := make(chan struct{})
+	timeoutMsg := fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
+	if req.h.Timeout > 0 && (timeout == 0 || req.h.Timeout < timeout) {
+		timeout = req.h.Timeout
+		timeoutMsg = fmt.Sprintf("rpc server: request handle timeout: client deadline within %s", timeout)
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// handlers read request metadata and set trailer through ctx
+	ctx, in := newIncomingContext(ctx, req.meta)
+	if req.stream != nil {
+		req.stream.ctx = ctx
+		req.replyv = reflect.ValueOf(req.stream)
+	}
+	// buffered, so that the handler goroutine never blocks after timeout
+	called := make(chan error, 1)
 	go func() {
-		err := req.svc.call(req.mtype, req.argv, req.replyv)
-		called <- struct{}{}
-		if err != nil {
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sending)
-			sent <- struct{}{}
+		// a queued request waits for its slots under the same deadline,
+		// if ctx is done while waiting it's handled below
+		if err := req.admission.wait(ctx); err != nil {
 			return
 		}
-		server.sendResponse(cc, req.h, req.replyv.Interface(), sending)
-		sent <- struct{}{}
+		// slots are held until the method returns, even if the response has been sent on timeout
+		defer req.admission.release()
+		called <- server.invoke(ctx, req)
 	}()
-	if timeout == 0 {
-		<-called
-		<-sent
-		return
-	}
 	select {
-	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-		server.sendResponse(cc, req.h, invalidRequest, sending)
-	case <-called:
-		// 取
-		<-sent
+	case <-ctx.Done():
+		req.closeStream()
+		if ctx.Err() != context.DeadlineExceeded {
+			return // cancelled by client or connection is closed, nobody is waiting for the response
+		}
+		setHeaderError(req.h, NewError(DeadlineExceeded, timeoutMsg))
+		req.h.Meta = in.takeTrailer()
+		server.sendResponse(cc, req.h, invalidRequest)
+	case err := <-called:
+		req.closeStream()
+		req.h.Meta = in.takeTrailer()
+		if err != nil {
+			setHeaderError(req.h, err)
+			server.sendResponse(cc, req.h, invalidRequest)
+			return
+		}
+		if req.stream != nil {
+			server.sendResponse(cc, req.h, nil) // end of stream
+			return
+		}
+		server.sendResponse(cc, req.h, req.replyv.Interface())
 	}
 }
 
-func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body interface{}, sending *sync.Mutex) {
-	sending.Lock()
-	defer sending.Unlock()
+// closeStream stops the stream of req from sending, so that the response is the last message
+func (req *request) closeStream() {
+	if req.stream != nil {
+		req.stream.close()
+	}
+}
+
+func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body interface{}) {
+	// one-way calls are never answered, nobody is waiting for the error
+	if h.Kind == codec.KindOneWay {
+		if h.Error != "" {
+			log.Printf("rpc server: one-way call %s error: %s", h.ServiceMethod, h.Error)
+		}
+		return
+	}
 	// add serverID to return
 	h.ServerID = server.serverID
+	h.Timeout = 0
 	if err := cc.Write(h, body); err != nil {
 		log.Println("rpc server: write response error:", err)
+		// reply may fail to encode while the conn is still fine,
+		// so try to tell client the reason instead of leaving the call pending
+		if body != invalidRequest {
+			setHeaderError(h, Errorf(Internal, "rpc server: write response error: %s", err))
+			_ = cc.Write(h, invalidRequest)
+		}
 	}
 }
 
 // Accept accepts connections on the listener and serves requests
 // for each incoming connection.
+// Accept returns once the listener is closed by Shutdown.
 func (server *Server) Accept(lis net.Listener) {
+	if !server.trackListener(lis, true) {
+		_ = lis.Close()
+		return
+	}
+	defer server.trackListener(lis, false)
 	for {
 		conn, err := lis.Accept() // once tpc conn have connection
 		if err != nil {
-			log.Println("rpc server: accept error:", err)
+			if !server.shuttingDown() {
+				log.Println("rpc server: accept error:", err)
+			}
 			return
 		}
 		go server.ServeConn(conn) // process it
@@ -247,10 +511,11 @@ func Accept(lis net.Listener) { DefaultServer.Accept(lis) }
 
 // Register publishes in the server the set of methods of the
 // receiver value that satisfy the following conditions:
-//	- exported method of exported type
-//	- two arguments, both of exported type
-//	- the second argument is a pointer
-//	- one return value, of type error
+//   - exported method of exported type
+//   - two arguments, both of exported type,
+//     optionally preceded by a context.Context
+//   - the second argument is a pointer
+//   - one return value, of type error
 func (server *Server) Register(rcvr interface{}) error {
 	s := newService(rcvr)
 	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
@@ -270,20 +535,20 @@ func Register(rcvr interface{}) error {
 func (server *Server) findService(serviceMethod string) (svc *service, mtype *methodType, err error) {
 	dot := strings.LastIndex(serviceMethod, ".")
 	if dot < 0 {
-		err = errors.New("rpc server: service/method request ill-formed: " + serviceMethod)
+		err = NewError(InvalidArgument, "rpc server: service/method request ill-formed: "+serviceMethod)
 		return
 	}
 	// no get dot
 	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
 	svci, ok := server.serviceMap.Load(serviceName)
 	if !ok {
-		err = errors.New("rpc server:can't find service " + serviceName)
+		err = NewError(NotFound, "rpc server:can't find service "+serviceName)
 		return
 	}
 	svc = svci.(*service)
 	mtype = svc.method[methodName]
 	if mtype == nil {
-		err = errors.New("rpc server:can't find method:" + methodName)
+		err = NewError(NotFound, "rpc server:can't find method:"+methodName)
 	}
 	return
 
@@ -0,0 +1,62 @@
+package yarpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+	"yarpc/codec"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 请求的 body 无法解析时只有这个调用失败，连接和同一连接上进行中的其他调用不受影响
+func TestServer_badBody(t *testing.T) {
+	server := NewServer(0)
+	_ = server.Register(new(Foo))
+	_ = server.Register(new(Slow))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown(context.Background()) }()
+	client, err := Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer func() { _ = client.Close() }()
+
+	var slept int
+	slow := client.Go("Slow.Sleep", 100*time.Millisecond, &slept, nil)
+	var sum int
+	_, err = client.Call(context.Background(), "Foo.Sum", "not args", &sum)
+	assert.Equal(t, InvalidArgument, ErrorCode(err))
+	_, err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &sum)
+	assert.Nil(t, err, "the connection should survive the bad body")
+	assert.Equal(t, 3, sum)
+	<-slow.Done
+	assert.Nil(t, slow.Error, "the call in flight should survive the bad body")
+	assert.Equal(t, 1, slept)
+	assert.True(t, client.IsAvailable())
+}
+
+// 未知 Kind 的消息被丢弃，连接和其他调用不受影响
+func TestServer_unknownKind(t *testing.T) {
+	server := NewServer(0)
+	_ = server.Register(new(Foo))
+	_ = server.Register(new(Slow))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown(context.Background()) }()
+	client, err := Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer func() { _ = client.Close() }()
+
+	var slept int
+	slow := client.Go("Slow.Sleep", 100*time.Millisecond, &slept, nil)
+	assert.Nil(t, client.writeControl(&codec.Header{Seq: 1 << 40, Kind: codec.KindGoAway}))
+	assert.Nil(t, client.writeControl(&codec.Header{Seq: 1<<40 + 1, Kind: codec.Kind(42)}))
+	var sum int
+	_, err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &sum)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, sum)
+	<-slow.Done
+	assert.Nil(t, slow.Error)
+	assert.True(t, client.IsAvailable())
+}
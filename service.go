@@ -1,18 +1,33 @@
 package yarpc
 
 import (
+	"context"
+	"fmt"
 	"go/ast"
 	"log"
 	"reflect"
+	"runtime"
 	"sync/atomic"
 )
 
+// methodKind tells how a method exchanges messages with client
+type methodKind uint8
+
+const (
+	unary           methodKind = iota // M([ctx,] args, *reply) error
+	serverStreaming                   // M(args, ServerStream) error
+	bidiStreaming                     // M(ServerStream) error, client streaming as well
+)
+
 // registered service 'type struct
 type methodType struct {
-	method    reflect.Method // 方法本身
-	ArgType   reflect.Type   // 传参类型
-	ReplyType reflect.Type   // 返回值类型
-	numCalls  uint64         // 调用次数统计
+	method      reflect.Method // 方法本身
+	ArgType     reflect.Type   // 传参类型
+	ReplyType   reflect.Type   // 返回值类型，流式方法为 ServerStream
+	numCalls    uint64         // 调用次数统计
+	numPanics   uint64         // panic 次数统计
+	withContext bool           // 第一个参数是否为 context.Context
+	kind        methodKind     // 普通调用或流式调用
 }
 
 // NumCalls return the number of a method called atomic
@@ -20,6 +35,16 @@ func (m *methodType) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numCalls)
 }
 
+// NumPanics return the number of panics recovered from the method atomic
+func (m *methodType) NumPanics() uint64 {
+	return atomic.LoadUint64(&m.numPanics)
+}
+
+// WithContext reports whether the method accepts a context.Context as first argument
+func (m *methodType) WithContext() bool {
+	return m.withContext
+}
+
 func (m *methodType) newArgv() reflect.Value {
 	var argv reflect.Value
 	// kind basic type:ptr
@@ -33,6 +58,7 @@ func (m *methodType) newArgv() reflect.Value {
 		// It returns the zero Value if v is nil.
 		// New 返回Type的ptr
 		// 先Elem再New出来的是ptr
+		// protobuf 生成的 message 都以指针形式实现 proto.Message，这里会得到一个新的空 message
 		argv = reflect.New(m.ArgType.Elem())
 	} else {
 		// 先New再Elem出来的是值
@@ -75,31 +101,73 @@ func newService(rcvr interface{}) *service {
 	return s
 }
 
+var (
+	typeOfError        = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext      = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfServerStream = reflect.TypeOf((*ServerStream)(nil)).Elem()
+)
+
 func (s *service) registerMethods() {
 	s.method = make(map[string]*methodType)
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
 		mType := method.Type
 		// 两个导出或内置类型的入参（反射时为 3 个，第 0 个是自身，
-		// 类似于 python 的 self，java 中的 this）
+		// 类似于 python 的 self，java 中的 this），
+		// 或者在两个入参之前再加一个 context.Context，
+		// 第二个入参为 ServerStream 的是服务端流式方法，
+		// 只有一个 ServerStream 入参的是客户端流式或双向流式方法，
+		// 流式方法同样可以在最前面加一个 context.Context，它和 stream.Context() 相同
 		// 返回值有且只有 1 个，类型为 error
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		if mType.NumOut() != 1 {
 			continue
 		}
 		// TypeOf error指针返回的是 *error,
 		// Elem方法返回的是error的reflect.Value类型
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		if mType.Out(0) != typeOfError {
 			continue
 		}
-		argType, replyType := mType.In(1), mType.In(2)
-		// check Exported in first letter
-		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
+		// params are the arguments after the receiver and the optional context
+		params := make([]reflect.Type, 0, mType.NumIn())
+		for j := 1; j < mType.NumIn(); j++ {
+			params = append(params, mType.In(j))
+		}
+		withContext := len(params) > 0 && params[0] == typeOfContext
+		if withContext {
+			params = params[1:]
+		}
+		// ServerStream is checked first, so that it's never taken as the reply of a unary method
+		kind := unary
+		switch {
+		case len(params) == 1 && params[0] == typeOfServerStream:
+			kind = bidiStreaming
+		case len(params) == 2 && params[1] == typeOfServerStream:
+			kind = serverStreaming
+		case len(params) == 2:
+		default:
 			continue
 		}
+		var argType, replyType reflect.Type
+		if kind == bidiStreaming {
+			replyType = typeOfServerStream // messages from client have no static type
+		} else {
+			argType, replyType = params[0], params[1]
+			// check Exported in first letter
+			if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
+				continue
+			}
+			// the reply is allocated by server and written by the method
+			if kind == unary && replyType.Kind() != reflect.Ptr {
+				log.Printf("rpc server: skip %s.%s, reply type %s is not a pointer\n", s.name, method.Name, replyType)
+				continue
+			}
+		}
 		s.method[method.Name] = &methodType{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
+			method:      method,
+			ArgType:     argType,
+			ReplyType:   replyType,
+			withContext: withContext,
+			kind:        kind,
 		}
 		log.Printf("rpc server: register %s,%s\n", s.name, method.Name)
 	}
@@ -109,11 +177,53 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
 
-func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
+// PanicError is the error of a call whose service method panicked
+type PanicError struct {
+	ServiceMethod string      // format "Service.Method"
+	Value         interface{} // value passed to panic
+	Stack         []byte      // stack trace of the panicking goroutine, not sent to client
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("rpc server: %s panic: %v", e.ServiceMethod, e.Value)
+}
+
+// recoverCall converts a panic into *PanicError stored in err,
+// it must be called directly by defer.
+// 一个方法 panic 只会让这一次调用失败，不会导致整个服务端进程退出。
+func (s *service) recoverCall(m *methodType, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	atomic.AddUint64(&m.numPanics, 1)
+	const size = 64 << 10
+	buf := make([]byte, size)
+	buf = buf[:runtime.Stack(buf, false)]
+	e := &PanicError{
+		ServiceMethod: s.name + "." + m.method.Name,
+		Value:         r,
+		Stack:         buf,
+	}
+	log.Printf("%v\n%s", e, e.Stack)
+	*err = e
+}
+
+// call invokes the method, ctx is passed only if the method accepts it
+func (s *service) call(ctx context.Context, m *methodType, argv, replyv reflect.Value) (err error) {
 	atomic.AddUint64(&m.numCalls, 1)
+	defer s.recoverCall(m, &err)
 	// reflect.Method.Func
 	f := m.method.Func
-	returnValues := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	in := []reflect.Value{s.rcvr}
+	if m.withContext {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	if m.kind != bidiStreaming {
+		in = append(in, argv)
+	}
+	in = append(in, replyv) // replyv is the stream of a streaming method
+	returnValues := f.Call(in)
 	if errInter := returnValues[0].Interface(); errInter != nil {
 		// 类型转换
 		return errInter.(error)
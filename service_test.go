@@ -1,9 +1,11 @@
 package yarpc
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -43,6 +45,45 @@ func TestMethodType_call(t *testing.T) {
 	argv := mType.newArgv()
 	replyv := mType.newReplyv()
 	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 2}))
-	err := s.call(mType, argv, replyv)
+	err := s.call(context.Background(), mType, argv, replyv)
 	assert.Equal(t, err, nil, "call should not return error")
 }
+
+type Ctx int
+
+func (c Ctx) Deadline(ctx context.Context, args int, reply *bool) error {
+	_, *reply = ctx.Deadline()
+	return nil
+}
+
+func TestMethodType_callWithContext(t *testing.T) {
+	var c Ctx
+	s := newService(&c)
+	mType := s.method["Deadline"]
+	_assert(mType != nil && mType.WithContext(), "method with context.Context should be registered")
+	replyv := mType.newReplyv()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := s.call(ctx, mType, mType.newArgv(), replyv)
+	assert.Nil(t, err)
+	assert.True(t, *replyv.Interface().(*bool), "handler should see the deadline")
+}
+
+type Panic int
+
+func (p Panic) Nil(args int, reply *int) error {
+	var m map[int]int
+	m[args] = args // panic: assignment to entry in nil map
+	return nil
+}
+
+func TestMethodType_callPanic(t *testing.T) {
+	var p Panic
+	s := newService(&p)
+	mType := s.method["Nil"]
+	err := s.call(context.Background(), mType, mType.newArgv(), mType.newReplyv())
+	e, ok := err.(*PanicError)
+	_assert(ok, "expect a *PanicError, got %v", err)
+	assert.Equal(t, "Panic.Nil", e.ServiceMethod)
+	assert.Equal(t, uint64(1), mType.NumPanics())
+}
@@ -0,0 +1,134 @@
+package yarpc
+
+import (
+	"context"
+	"log"
+	"net"
+	"yarpc/codec"
+)
+
+// 优雅关闭
+// Server.Shutdown 依次完成以下几步：
+// 1）关闭 Accept 中的 listener，不再接受新连接，握手中的连接会被拒绝；
+// 2）向每个连接发送 GOAWAY 消息（Header.Kind 为 codec.KindGoAway），
+// 客户端收到后不再在该连接上发送新请求，已发出的请求仍会得到响应，
+// 在 GOAWAY 之前已经发出、之后才到达的请求，服务端回复 Unavailable，调用方可以换一个连接重试；
+// 3）等待正在处理的请求完成，直到 ctx 结束；
+// 4）关闭所有连接，仍未完成的请求的 context 随之取消。
+
+// errServerShutdown is sent to client when the server is shutting down
+var errServerShutdown = NewError(Unavailable, "rpc server: server is shutting down")
+
+// Shutdown gracefully shuts down the server without interrupting in-flight requests.
+// It returns ctx.Err() if ctx ends before all requests are done,
+// the connections are closed in either case.
+// Connections served through HandleHTTP are drained too,
+// but the http listener should be closed by its own http.Server.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	server.inShutdown = true
+	for lis := range server.listeners {
+		if err := lis.Close(); err != nil {
+			log.Println("rpc server: close listener error:", err)
+		}
+	}
+	server.listeners = nil
+	server.mu.Unlock()
+
+	// no connection is tracked after inShutdown is set, so conns is complete
+	var conns []*connState
+	server.conns.Range(func(statei, _ interface{}) bool {
+		conns = append(conns, statei.(*connState))
+		return true
+	})
+	// the forced close below also ends GOAWAY writes blocked by peers not reading
+	for _, state := range conns {
+		state.goAway()
+	}
+	done := make(chan struct{})
+	go func() {
+		for _, state := range conns {
+			state.wg.Wait()
+		}
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	for _, state := range conns {
+		_ = state.cc.Close()
+	}
+	return err
+}
+
+// Shutdown gracefully shuts down the DefaultServer.
+func Shutdown(ctx context.Context) error { return DefaultServer.Shutdown(ctx) }
+
+func (server *Server) shuttingDown() bool {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	return server.inShutdown
+}
+
+// trackListener adds or removes lis, false is returned if lis can't be added
+// because the server is shutting down.
+func (server *Server) trackListener(lis net.Listener, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.listeners, lis)
+		return true
+	}
+	if server.inShutdown {
+		return false
+	}
+	if server.listeners == nil {
+		server.listeners = make(map[net.Listener]struct{})
+	}
+	server.listeners[lis] = struct{}{}
+	return true
+}
+
+// trackConn adds state to conns unless the server is shutting down
+func (server *Server) trackConn(state *connState) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.inShutdown {
+		return false
+	}
+	server.conns.Store(state, struct{}{})
+	return true
+}
+
+// addRequest counts a new request in, false is returned once GOAWAY is sent.
+// It's done under mu, so that wg.Wait in Shutdown never races with wg.Add.
+func (state *connState) addRequest() bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.draining {
+		return false
+	}
+	state.wg.Add(1)
+	return true
+}
+
+// goAway stops accepting requests on the connection and tells client to do so.
+// GOAWAY is written asynchronously, so that a peer not reading can't block the caller,
+// the returned channel is closed once it's written or failed.
+func (state *connState) goAway() <-chan struct{} {
+	state.mu.Lock()
+	state.draining = true
+	state.mu.Unlock()
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		if err := state.cc.Write(&codec.Header{Kind: codec.KindGoAway}, nil); err != nil {
+			log.Println("rpc server: send goaway error:", err)
+		}
+	}()
+	return sent
+}
@@ -0,0 +1,122 @@
+package yarpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type Slow int
+
+func (s Slow) Sleep(ctx context.Context, d time.Duration, reply *int) error {
+	select {
+	case <-time.After(d):
+		*reply = 1
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func startSlowServer(t *testing.T) (*Server, string, chan struct{}) {
+	server := NewServer(0)
+	_ = server.Register(new(Slow))
+	l, err := net.Listen("tcp", ":0")
+	assert.Nil(t, err)
+	accepting := make(chan struct{})
+	go func() {
+		server.Accept(l)
+		close(accepting)
+	}()
+	return server, l.Addr().String(), accepting
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	server, addr, accepting := startSlowServer(t)
+	client, err := Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	call := client.Go("Slow.Sleep", 300*time.Millisecond, &reply, nil)
+	time.Sleep(50 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// GOAWAY has arrived, new calls are not sent
+	_, err = client.Call(context.Background(), "Slow.Sleep", time.Duration(0), &reply)
+	assert.True(t, errors.Is(err, ErrGoAway))
+	assert.False(t, client.IsAvailable())
+
+	// the in-flight call is drained
+	call = <-call.Done
+	assert.Nil(t, call.Error)
+	assert.Equal(t, 1, reply)
+	assert.Nil(t, <-shutdown)
+	<-accepting
+
+	_, err = Dial("tcp", addr)
+	assert.NotNil(t, err)
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	server, addr, _ := startSlowServer(t)
+	client, err := Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	call := client.Go("Slow.Sleep", 10*time.Second, &reply, nil)
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, server.Shutdown(ctx))
+	select {
+	case call = <-call.Done:
+		assert.Equal(t, Unavailable, ErrorCode(call.Error))
+	case <-time.After(time.Second):
+		t.Fatal("expect the call to fail once the connection is closed")
+	}
+}
+
+func TestServer_ShutdownPeerNotReading(t *testing.T) {
+	server := NewServer(0)
+	_ = server.Register(new(Slow))
+	serverConn, clientConn := net.Pipe()
+	defer func() { _ = clientConn.Close() }()
+	served := make(chan struct{})
+	go func() {
+		server.ServeConn(serverConn)
+		close(served)
+	}()
+	go func() { _ = writeOption(clientConn, DefaultOption) }()
+	_, err := readHandshakeReply(clientConn)
+	assert.Nil(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	// writes on net.Pipe block until the peer reads, so GOAWAY is never sent
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(ctx) }()
+	select {
+	case <-shutdown:
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown is blocked by a peer not reading")
+	}
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("connection is not closed after Shutdown")
+	}
+}
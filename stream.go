@@ -0,0 +1,430 @@
+package yarpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+	"yarpc/codec"
+)
+
+// 流式调用
+// 服务端流式方法的签名为 M([ctx,] args, stream ServerStream) error，
+// 客户端流式和双向流式方法的签名为 M([ctx,] stream ServerStream) error。
+// 客户端通过 Client.Stream 调用服务端流式方法，请求与普通调用相同，发送 args 后即半关闭；
+// 通过 Client.NewStream 调用客户端流式和双向流式方法，请求不带 body，
+// 之后 ClientStream.Send 发送的消息和服务端 stream.Send 发送的消息一样，
+// 都是 Header.Kind 为 codec.KindStreamMsg、Seq 与请求相同的帧，
+// 客户端 CloseSend 发送 codec.KindStreamEnd 表示不再发送消息（半关闭），服务端 Recv 随后返回 io.EOF。
+// 多个流和普通调用在同一个连接上按 Seq 复用。
+// 方法返回后服务端发送这次调用的响应作为流的结束，响应不带 body，
+// 方法返回的错误和 trailer 随响应一起发送，客户端 Recv 依次返回所有消息之后返回 io.EOF 或该错误。
+// 客户端 ctx 结束时和普通调用一样发送取消消息，服务端随即取消 stream.Context()。
+//
+// 流控：每个流的每个方向上，发送方最多有 streamWindow 条消息未被接收方 Recv 取走，
+// 接收方每取走一半窗口的消息，就发送 codec.KindStreamWindow 归还相应的额度，
+// 额度用完时 Send 阻塞，因此读取连接的协程从不阻塞，慢的接收方也不会让对端无限制地缓存消息。
+//
+// 服务端收到消息时还不知道其类型，先保留未解码的 body，Recv 时再解码，
+// 这要求编解码器实现 codec.RawBodyCodec。
+// 流式调用不经过 unary 拦截器。
+
+// streamWindow is the number of messages a stream may send before the receiver takes them
+const streamWindow = 64
+
+// ServerStream is used by a streaming method to exchange messages with client
+type ServerStream interface {
+	// Context returns the context of the call, it carries the request metadata
+	Context() context.Context
+	// Send sends m to client, it blocks if client is slow to receive,
+	// and returns an error once the call is done
+	Send(m interface{}) error
+	// Recv stores the next message from client into m,
+	// io.EOF is returned after client has closed sending.
+	// Server streaming methods receive io.EOF at once.
+	Recv(m interface{}) error
+}
+
+// errStreamDone is returned by Send after the method has returned or timed out
+var errStreamDone = errors.New("rpc server: stream is done")
+
+type serverStream struct {
+	ctx    context.Context // set before the method is invoked
+	cc     codec.Codec
+	seq    uint64
+	window *sendWindow
+	recv   *recvBuffer // raw bodies of client messages
+	mu     sync.Mutex  // protect done, so that no message is sent after the response
+	done   bool
+}
+
+// newServerStream creates the stream when the request is read,
+// so that the following messages of client are never missed.
+func newServerStream(cc codec.Codec, seq uint64, kind methodKind) *serverStream {
+	s := &serverStream{
+		cc:     cc,
+		seq:    seq,
+		window: newSendWindow(),
+		recv:   newRecvBuffer(),
+	}
+	if kind == serverStreaming {
+		s.recv.end() // args is the only message from client
+	}
+	return s
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *serverStream) Send(m interface{}) error {
+	if !s.window.acquire(s.ctx.Done()) {
+		return s.ctx.Err()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return errStreamDone
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	return s.cc.Write(&codec.Header{Seq: s.seq, Kind: codec.KindStreamMsg}, m)
+}
+
+func (s *serverStream) Recv(m interface{}) error {
+	msg, grant, err := s.recv.next(s.ctx.Done())
+	if err == errRecvDone {
+		return s.ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	if grant > 0 {
+		s.writeControl(&codec.Header{Seq: s.seq, Kind: codec.KindStreamWindow, Window: grant})
+	}
+	return s.cc.(codec.RawBodyCodec).DecodeBody(msg.([]byte), m)
+}
+
+// receive handles a stream message from client, it's called by serveCodec
+func (s *serverStream) receive(h *codec.Header) {
+	switch h.Kind {
+	case codec.KindStreamMsg:
+		raw, err := s.cc.(codec.RawBodyCodec).ReadRawBody()
+		if err != nil {
+			log.Println("rpc server: read stream message error:", err)
+			return
+		}
+		s.recv.push(raw)
+	case codec.KindStreamEnd:
+		s.recv.end()
+	case codec.KindStreamWindow:
+		s.window.add(h.Window)
+	}
+}
+
+func (s *serverStream) writeControl(h *codec.Header) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	if err := s.cc.Write(h, nil); err != nil {
+		log.Println("rpc server: write stream control error:", err)
+	}
+}
+
+// close stops sending, it's called before the response ends the stream
+func (s *serverStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done = true
+}
+
+// ClientStream exchanges the messages of a streaming call with server.
+// Send and Recv may be called from different goroutines,
+// but neither of them should be called from multiple goroutines at the same time.
+type ClientStream struct {
+	client *Client
+	call   *Call
+	ctx    context.Context
+	typ    reflect.Type // type of messages from server
+	window *sendWindow
+	recv   *recvBuffer   // decoded messages from server
+	done   chan struct{} // closed once the call is done, err is set
+	mu     sync.Mutex    // protect following
+	closed bool          // CloseSend has been called
+	err    error         // io.EOF or error of the call
+}
+
+// Stream calls the server streaming method serviceMethod with args.
+// reply is a pointer, messages are decoded into new values of the type it points to.
+// The stream ends when the method returns, or ctx is done,
+// cancel ctx to stop receiving early.
+func (client *Client) Stream(ctx context.Context, serviceMethod string, args, reply interface{}) (*ClientStream, error) {
+	return client.newStream(ctx, serviceMethod, args, reply, true)
+}
+
+// NewStream calls the client or bidirectional streaming method serviceMethod,
+// messages are sent by Send until CloseSend, and received by Recv like Stream.
+func (client *Client) NewStream(ctx context.Context, serviceMethod string, reply interface{}) (*ClientStream, error) {
+	return client.newStream(ctx, serviceMethod, nil, reply, false)
+}
+
+func (client *Client) newStream(ctx context.Context, serviceMethod string, args, reply interface{}, closed bool) (*ClientStream, error) {
+	typ := reflect.TypeOf(reply)
+	if typ == nil || typ.Kind() != reflect.Ptr {
+		return nil, Errorf(InvalidArgument, "rpc client: stream reply must be a pointer, got %T", reply)
+	}
+	call := newCall(serviceMethod, args, nil, make(chan *Call, 1))
+	call.deadline, _ = ctx.Deadline()
+	call.meta, _ = FromOutgoingContext(ctx)
+	stream := &ClientStream{
+		client: client,
+		call:   call,
+		ctx:    ctx,
+		typ:    typ.Elem(),
+		window: newSendWindow(),
+		recv:   newRecvBuffer(),
+		done:   make(chan struct{}),
+		closed: closed,
+	}
+	call.stream = stream
+	client.send(call)
+	go stream.wait()
+	return stream, nil
+}
+
+// wait for the end of the call, like Client.invoke
+func (s *ClientStream) wait() {
+	var err error
+	select {
+	case <-s.ctx.Done():
+		if s.client.removeCall(s.call.Seq) != nil {
+			s.client.sendCancel(s.call.Seq)
+		}
+		err = &Error{
+			Code:    AsError(s.ctx.Err()).Code,
+			Message: "rpc client:stream failed:" + s.ctx.Err().Error(),
+			cause:   s.ctx.Err(),
+		}
+	case call := <-s.call.Done:
+		if err = call.Error; err == nil {
+			err = io.EOF
+		}
+		if trailer := trailerFromContext(s.ctx); trailer != nil {
+			*trailer = call.Trailer
+		}
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+	close(s.done)
+}
+
+func (s *ClientStream) result() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Send sends m to server, it blocks if server is slow to receive.
+// It returns io.EOF or the error of the call once the call is done.
+func (s *ClientStream) Send(m interface{}) error {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return Errorf(FailedPrecondition, "rpc client: send on closed stream %s", s.call.ServiceMethod)
+	}
+	if !s.window.acquire(s.done) {
+		return s.result()
+	}
+	select {
+	case <-s.done:
+		return s.result()
+	default:
+	}
+	return s.client.cc.Write(&codec.Header{Seq: s.call.Seq, Kind: codec.KindStreamMsg}, m)
+}
+
+// CloseSend tells server that no more message will be sent,
+// messages from server are still received by Recv.
+func (s *ClientStream) CloseSend() error {
+	s.mu.Lock()
+	if s.closed || s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	return s.client.writeControl(&codec.Header{Seq: s.call.Seq, Kind: codec.KindStreamEnd})
+}
+
+// Recv stores the next message into reply, which must have the type given to Stream.
+// It returns io.EOF after all messages are received,
+// or the error of the call if it failed.
+func (s *ClientStream) Recv(reply interface{}) error {
+	rv := reflect.ValueOf(reply)
+	if rv.Kind() != reflect.Ptr || rv.Type().Elem() != s.typ {
+		return Errorf(InvalidArgument, "rpc client: stream reply must be *%s, got %T", s.typ, reply)
+	}
+	msg, grant, err := s.recv.next(s.done)
+	if err != nil {
+		return s.result()
+	}
+	if grant > 0 && s.result() == nil {
+		if err := s.client.writeControl(&codec.Header{Seq: s.call.Seq, Kind: codec.KindStreamWindow, Window: grant}); err != nil {
+			log.Println("rpc client: write stream window error:", err)
+		}
+	}
+	rv.Elem().Set(msg.(reflect.Value).Elem())
+	return nil
+}
+
+// receiveStream handles a stream message of the pending call h.Seq,
+// the call fails if the message can't be decoded
+func (client *Client) receiveStream(h *codec.Header) error {
+	client.mu.Lock()
+	call := client.pending[h.Seq]
+	client.mu.Unlock()
+	if call == nil || call.stream == nil {
+		// the call is done or cancelled
+		return client.cc.ReadBody(nil)
+	}
+	if h.Kind == codec.KindStreamWindow {
+		call.stream.window.add(h.Window)
+		return client.cc.ReadBody(nil)
+	}
+	msg := reflect.New(call.stream.typ)
+	if err := client.cc.ReadBody(msg.Interface()); err != nil {
+		log.Println("rpc client: read stream message error:", err)
+		if call = client.removeCall(h.Seq); call != nil {
+			call.Error = Errorf(Internal, "reading stream message %s", err)
+			call.done()
+			client.sendCancel(h.Seq)
+		}
+		return nil // a bad body only fails this call, the next frame is still readable
+	}
+	call.stream.recv.push(msg)
+	return nil
+}
+
+// sendWindow counts the messages a stream may send before the receiver grants more
+type sendWindow struct {
+	mu      sync.Mutex
+	credits uint32
+	notify  chan struct{} // credits are added
+}
+
+func newSendWindow() *sendWindow {
+	return &sendWindow{credits: streamWindow, notify: make(chan struct{}, 1)}
+}
+
+// acquire takes one credit, it blocks until credits are added or done is closed
+func (w *sendWindow) acquire(done <-chan struct{}) bool {
+	for {
+		w.mu.Lock()
+		if w.credits > 0 {
+			w.credits--
+			more := w.credits > 0
+			w.mu.Unlock()
+			if more {
+				w.wake() // pass the notification on to other senders
+			}
+			return true
+		}
+		w.mu.Unlock()
+		select {
+		case <-w.notify:
+		case <-done:
+			return false
+		}
+	}
+}
+
+func (w *sendWindow) add(n uint32) {
+	w.mu.Lock()
+	w.credits += n
+	w.mu.Unlock()
+	w.wake()
+}
+
+func (w *sendWindow) wake() {
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// errRecvDone is returned by recvBuffer.next when done is closed
+var errRecvDone = errors.New("rpc: stream is done")
+
+// recvBuffer buffers the messages received by a stream until they're taken by Recv
+type recvBuffer struct {
+	mu       sync.Mutex
+	msgs     []interface{}
+	ended    bool   // peer won't send more messages
+	consumed uint32 // messages taken since the last window update
+	notify   chan struct{}
+}
+
+func newRecvBuffer() *recvBuffer {
+	return &recvBuffer{notify: make(chan struct{}, 1)}
+}
+
+func (b *recvBuffer) push(msg interface{}) {
+	b.mu.Lock()
+	b.msgs = append(b.msgs, msg)
+	b.mu.Unlock()
+	b.wake()
+}
+
+func (b *recvBuffer) end() {
+	b.mu.Lock()
+	b.ended = true
+	b.mu.Unlock()
+	b.wake()
+}
+
+func (b *recvBuffer) wake() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// next waits for the next message, messages buffered before done is closed are still returned.
+// grant is the window to give back to the peer, 0 if it's not time yet.
+// io.EOF is returned after the peer ended, errRecvDone after done is closed.
+func (b *recvBuffer) next(done <-chan struct{}) (msg interface{}, grant uint32, err error) {
+	stopped := false
+	for {
+		b.mu.Lock()
+		if len(b.msgs) > 0 {
+			msg = b.msgs[0]
+			b.msgs[0] = nil
+			b.msgs = b.msgs[1:]
+			if b.consumed++; b.consumed >= streamWindow/2 {
+				grant, b.consumed = b.consumed, 0
+			}
+			b.mu.Unlock()
+			return msg, grant, nil
+		}
+		ended := b.ended
+		b.mu.Unlock()
+		switch {
+		case ended:
+			return nil, 0, io.EOF
+		case stopped:
+			return nil, 0, errRecvDone
+		}
+		select {
+		case <-b.notify:
+		case <-done:
+			stopped = true
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package yarpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type Counter int
+
+func (c Counter) Count(n int, stream ServerStream) error {
+	for i := 0; i < n; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+	}
+	return SetTrailer(stream.Context(), Metadata{"count": "done"})
+}
+
+func (c Counter) Fail(n int, stream ServerStream) error {
+	_ = stream.Send(n)
+	return NewError(Aborted, "count aborted")
+}
+
+var streamCancelled = make(chan error, 1)
+
+func (c Counter) Forever(n int, stream ServerStream) error {
+	for {
+		if err := stream.Send(n); err != nil {
+			streamCancelled <- stream.Context().Err()
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Sum receives numbers until client closes sending, and replies their sum
+func (c Counter) Sum(stream ServerStream) error {
+	var sum int
+	for {
+		var n int
+		err := stream.Recv(&n)
+		if err == io.EOF {
+			return stream.Send(sum)
+		}
+		if err != nil {
+			return err
+		}
+		sum += n
+	}
+}
+
+// Double replies each number doubled
+func (c Counter) Double(stream ServerStream) error {
+	for {
+		var n int
+		if err := stream.Recv(&n); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			streamCancelled <- err
+			return err
+		}
+		if err := stream.Send(2 * n); err != nil {
+			return err
+		}
+	}
+}
+
+func TestNewService_stream(t *testing.T) {
+	s := newService(new(Counter))
+	assert.Equal(t, 5, len(s.method))
+	assert.Equal(t, serverStreaming, s.method["Count"].kind)
+	assert.Equal(t, bidiStreaming, s.method["Sum"].kind)
+	assert.Nil(t, s.method["Sum"].ArgType)
+}
+
+// Watcher has streaming methods accepting a context, and a unary method whose reply is not a pointer
+type Watcher int
+
+func (w Watcher) Watch(ctx context.Context, n int, stream ServerStream) error {
+	if ctx != stream.Context() {
+		return NewError(Internal, "ctx is not the context of stream")
+	}
+	return stream.Send(n)
+}
+
+func (w Watcher) Echo(ctx context.Context, stream ServerStream) error {
+	var n int
+	if err := stream.Recv(&n); err != nil {
+		return err
+	}
+	return stream.Send(n)
+}
+
+func (w Watcher) Value(n int, reply int) error { return nil }
+
+func TestNewService_streamWithContext(t *testing.T) {
+	s := newService(new(Watcher))
+	assert.Equal(t, 2, len(s.method))
+	assert.Equal(t, serverStreaming, s.method["Watch"].kind)
+	assert.True(t, s.method["Watch"].WithContext())
+	assert.Equal(t, bidiStreaming, s.method["Echo"].kind)
+	assert.True(t, s.method["Echo"].WithContext())
+
+	server := NewServer(0)
+	_ = server.Register(new(Watcher))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer func() { _ = client.Close() }()
+
+	stream, err := client.Stream(context.Background(), "Watcher.Watch", 3, new(int))
+	assert.Nil(t, err)
+	var n int
+	assert.Nil(t, stream.Recv(&n))
+	assert.Equal(t, 3, n)
+	assert.Equal(t, io.EOF, stream.Recv(&n))
+
+	stream, err = client.NewStream(context.Background(), "Watcher.Echo", new(int))
+	assert.Nil(t, err)
+	assert.Nil(t, stream.Send(4))
+	assert.Nil(t, stream.Recv(&n))
+	assert.Equal(t, 4, n)
+	assert.Equal(t, io.EOF, stream.Recv(&n))
+}
+
+func TestClient_Stream(t *testing.T) {
+	server := NewServer(0)
+	_ = server.Register(new(Counter))
+	_ = server.Register(new(Foo))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer func() { _ = client.Close() }()
+
+	t.Run("messages and trailer", func(t *testing.T) {
+		var trailer Metadata
+		stream, err := client.Stream(WithTrailer(context.Background(), &trailer), "Counter.Count", 5, new(int))
+		assert.Nil(t, err)
+		// unary calls are multiplexed with the stream on the same connection
+		var sum int
+		assert.Nil(t, client.CallWithoutServerID(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &sum))
+		var got []int
+		for {
+			var n int
+			if err = stream.Recv(&n); err != nil {
+				break
+			}
+			got = append(got, n)
+		}
+		assert.Equal(t, io.EOF, err)
+		assert.Equal(t, []int{0, 1, 2, 3, 4}, got)
+		assert.Equal(t, "done", trailer["count"])
+		assert.Equal(t, io.EOF, stream.Recv(new(int)))
+	})
+	t.Run("error", func(t *testing.T) {
+		stream, _ := client.Stream(context.Background(), "Counter.Fail", 7, new(int))
+		var n int
+		assert.Nil(t, stream.Recv(&n))
+		assert.Equal(t, 7, n)
+		err := stream.Recv(&n)
+		assert.Equal(t, Aborted, ErrorCode(err))
+		assert.Equal(t, InvalidArgument, ErrorCode(stream.Recv(new(string))))
+	})
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, _ := client.Stream(ctx, "Counter.Forever", 1, new(int))
+		var n int
+		assert.Nil(t, stream.Recv(&n))
+		cancel()
+		for err = stream.Recv(&n); err == nil; err = stream.Recv(&n) {
+		}
+		assert.Equal(t, Canceled, ErrorCode(err))
+		select {
+		case err := <-streamCancelled:
+			assert.Equal(t, context.Canceled, err)
+		case <-time.After(time.Second):
+			t.Fatal("expect the stream to be cancelled on server")
+		}
+	})
+	t.Run("flow control", func(t *testing.T) {
+		stream, _ := client.Stream(context.Background(), "Counter.Count", 10*streamWindow, new(int))
+		time.Sleep(100 * time.Millisecond)
+		// server stops sending until the messages are taken
+		stream.recv.mu.Lock()
+		buffered := len(stream.recv.msgs)
+		stream.recv.mu.Unlock()
+		assert.Equal(t, streamWindow, buffered)
+		var n, count int
+		for ; stream.Recv(&n) == nil; count++ {
+			assert.Equal(t, count, n)
+		}
+		assert.Equal(t, 10*streamWindow, count)
+	})
+	t.Run("client streaming", func(t *testing.T) {
+		stream, err := client.NewStream(context.Background(), "Counter.Sum", new(int))
+		assert.Nil(t, err)
+		for i := 1; i <= 3*streamWindow; i++ {
+			assert.Nil(t, stream.Send(i))
+		}
+		assert.Nil(t, stream.CloseSend())
+		assert.Equal(t, FailedPrecondition, ErrorCode(stream.Send(1)))
+		var sum int
+		assert.Nil(t, stream.Recv(&sum))
+		assert.Equal(t, 3*streamWindow*(3*streamWindow+1)/2, sum)
+		assert.Equal(t, io.EOF, stream.Recv(&sum))
+	})
+	t.Run("bidirectional streaming", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, _ := client.NewStream(ctx, "Counter.Double", new(int))
+		for i := 0; i < 3; i++ {
+			var n int
+			assert.Nil(t, stream.Send(i))
+			assert.Nil(t, stream.Recv(&n))
+			assert.Equal(t, 2*i, n)
+		}
+		cancel()
+		assert.Equal(t, Canceled, ErrorCode(stream.Recv(new(int))))
+		select {
+		case err := <-streamCancelled:
+			assert.Equal(t, context.Canceled, err)
+		case <-time.After(time.Second):
+			t.Fatal("expect the stream to be cancelled on server")
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package xclient
+
+import (
+	"context"
+	"time"
+	. "yarpc"
+)
+
+// 对冲请求
+// 读多写少的方法，p99 延迟往往由某一个慢实例决定。
+// 通过 XClient.SetHedgePolicy 为 Methods 中的方法开启对冲：
+// 先按 SelectMode 调用一个实例，Delay 内没有返回时，再把同样的请求发给 Discovery.GetAll 中另一个没有调用过的实例，
+// 直到发出 MaxAttempts 个请求或没有更多实例。
+// 每个请求使用各自克隆的 reply（与 Broadcast 相同），采用第一个成功的结果，然后取消其余仍在进行中的请求。
+// NonFatalCodes 中的错误（默认是 Unavailable 和 ResourceExhausted，
+// 即请求没有被处理：连接不可用或被并发限制拒绝）不结束对冲：立即发出下一个请求，
+// 并继续等待其他进行中的请求，全部失败时返回最后一个错误；
+// 其他错误码说明请求已被服务端处理，直接返回该错误。拨号同样受 ctx 控制，被取消的请求不会卡在拨号上。
+// 对冲的方法会被多个实例重复执行，只能用于幂等的方法。对冲的方法不再按 RetryPolicy 重试。
+
+// HedgePolicy configures hedged calls of XClient
+type HedgePolicy struct {
+	Delay       time.Duration   // wait before sending the call to another server
+	MaxAttempts int             // calls sent at most including the first one, 0 means 2
+	Methods     map[string]bool // "Service.Method" to hedge, they must be idempotent
+	// NonFatalCodes are errors that don't end hedging,
+	// nil means Unavailable and ResourceExhausted
+	NonFatalCodes []Code
+}
+
+const defaultHedgeAttempts = 2
+
+// SetHedgePolicy sets which calls are hedged,
+// it should be called before any call is made.
+func (xc *XClient) SetHedgePolicy(p HedgePolicy) {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultHedgeAttempts
+	}
+	if p.NonFatalCodes == nil {
+		p.NonFatalCodes = []Code{Unavailable, ResourceExhausted}
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.hedge = p
+}
+
+// hedgeResult is the outcome of one of the hedged calls
+type hedgeResult struct {
+	serverID int
+	reply    interface{}
+	err      error
+}
+
+// callHedged sends the call to more servers while it's slow, and takes the first successful reply
+func (xc *XClient) callHedged(ctx context.Context, serviceMethod string, args, reply interface{}) (serverID int, err error) {
+	xc.mu.Lock()
+	p := xc.hedge
+	xc.mu.Unlock()
+	first, err := xc.d.Get(xc.mode)
+	if err != nil {
+		return 0, err
+	}
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return 0, err
+	}
+	// the first server is chosen by SelectMode, the others in order of discovery
+	targets := []string{first}
+	for _, s := range servers {
+		if s != first && len(targets) < p.MaxAttempts {
+			targets = append(targets, s)
+		}
+	}
+
+	// cancel the calls still in flight once a reply is taken
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan hedgeResult, len(targets))
+	send := func(rpcAddr string) {
+		clonedReply := cloneReply(reply)
+		go func() {
+			serverID, err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			results <- hedgeResult{serverID: serverID, reply: clonedReply, err: err}
+		}()
+	}
+	send(targets[0])
+	sent, inflight := 1, 1
+	timer := time.NewTimer(p.Delay)
+	defer timer.Stop()
+	for {
+		select {
+		case r := <-results:
+			inflight--
+			if r.err == nil {
+				if reply != nil {
+					setReply(reply, r.reply)
+				}
+				return r.serverID, nil
+			}
+			serverID, err = r.serverID, r.err
+			if !p.nonFatal(r.err) {
+				return serverID, err
+			}
+			if sent < len(targets) && ctx.Err() == nil {
+				// the call isn't handled by the server, try the next one right now
+				send(targets[sent])
+				sent++
+				inflight++
+			}
+			if inflight == 0 {
+				return serverID, err
+			}
+		case <-timer.C:
+			if sent < len(targets) && ctx.Err() == nil {
+				send(targets[sent])
+				sent++
+				inflight++
+				timer.Reset(p.Delay)
+			}
+		}
+	}
+}
+
+// nonFatal reports whether err means the call wasn't handled, so other attempts are still waited for
+func (p *HedgePolicy) nonFatal(err error) bool {
+	code := ErrorCode(err)
+	for _, c := range p.NonFatalCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
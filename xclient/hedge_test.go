@@ -0,0 +1,162 @@
+package xclient
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+	. "yarpc"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Replica answers after delay, or fails with code if it's set,
+// cancelled receives the error of calls cancelled before that
+type Replica struct {
+	delay     time.Duration
+	code      Code
+	cancelled chan error
+}
+
+func (r *Replica) Read(ctx context.Context, n int, reply *int) error {
+	select {
+	case <-time.After(r.delay):
+		if r.code != OK {
+			return NewError(r.code, "replica failed")
+		}
+		*reply = n
+		return nil
+	case <-ctx.Done():
+		r.cancelled <- ctx.Err()
+		return ctx.Err()
+	}
+}
+
+func startReplica(t *testing.T, delay time.Duration) (*Replica, string) {
+	r := &Replica{delay: delay, cancelled: make(chan error, 10)}
+	server := NewServer(0)
+	_ = server.Register(r)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	t.Cleanup(func() { _ = server.Shutdown(context.Background()) })
+	return r, "tcp@" + l.Addr().String()
+}
+
+func TestXClient_SetHedgePolicy(t *testing.T) {
+	ctx := context.Background()
+	policy := HedgePolicy{Delay: 20 * time.Millisecond, Methods: map[string]bool{"Replica.Read": true}}
+	t.Run("slow server", func(t *testing.T) {
+		slow, slowAddr := startReplica(t, time.Second)
+		_, fastAddr := startReplica(t, 0)
+		xc := NewXClient(NewMultiServerDiscovery([]string{slowAddr, fastAddr}), RoundRobinSelect, DefaultOption)
+		defer func() { _ = xc.Close() }()
+		xc.SetHedgePolicy(policy)
+		for i := 0; i < 4; i++ {
+			start := time.Now()
+			var reply int
+			_, err := xc.Call(ctx, "Replica.Read", i, &reply)
+			assert.Nil(t, err)
+			assert.Equal(t, i, reply)
+			assert.Less(t, int64(time.Since(start)), int64(500*time.Millisecond), "the fast server should answer")
+		}
+		// every call starting at the slow server is cancelled there once the fast one answers
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-slow.cancelled:
+				assert.Equal(t, context.Canceled, err)
+			case <-time.After(time.Second):
+				t.Fatal("expect the slow call to be cancelled")
+			}
+		}
+	})
+	t.Run("unavailable", func(t *testing.T) {
+		_, addr := startReplica(t, 0)
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		down := "tcp@" + l.Addr().String()
+		_ = l.Close()
+		xc := NewXClient(NewMultiServerDiscovery([]string{down, addr}), RoundRobinSelect, DefaultOption)
+		defer func() { _ = xc.Close() }()
+		xc.SetHedgePolicy(HedgePolicy{Delay: time.Hour, Methods: policy.Methods})
+		for i := 0; i < 2; i++ {
+			var reply int
+			_, err := xc.Call(ctx, "Replica.Read", i, &reply)
+			assert.Nil(t, err, "the next server should be called without waiting for Delay")
+			assert.Equal(t, i, reply)
+		}
+	})
+	t.Run("error", func(t *testing.T) {
+		_, addr := startReplica(t, 0)
+		xc := NewXClient(NewMultiServerDiscovery([]string{addr}), RandomSelect, DefaultOption)
+		defer func() { _ = xc.Close() }()
+		xc.SetHedgePolicy(HedgePolicy{Delay: 10 * time.Millisecond, Methods: map[string]bool{"Replica.Write": true}})
+		_, err := xc.Call(ctx, "Replica.Write", 1, new(int))
+		assert.NotNil(t, err)
+		assert.NotEqual(t, Unavailable, ErrorCode(err))
+	})
+	t.Run("rejected", func(t *testing.T) {
+		busy, busyAddr := startReplica(t, 50*time.Millisecond)
+		busy.code = ResourceExhausted
+		_, slowAddr := startReplica(t, 100*time.Millisecond)
+		xc := NewXClient(NewMultiServerDiscovery([]string{busyAddr, slowAddr}), RoundRobinSelect, DefaultOption)
+		defer func() { _ = xc.Close() }()
+		xc.SetHedgePolicy(HedgePolicy{Delay: 10 * time.Millisecond, Methods: policy.Methods})
+		for i := 0; i < 2; i++ {
+			var reply int
+			_, err := xc.Call(ctx, "Replica.Read", i, &reply)
+			assert.Nil(t, err, "the hedge in flight should be waited for after the call is rejected")
+			assert.Equal(t, i, reply)
+		}
+	})
+	t.Run("deadline exceeded", func(t *testing.T) {
+		timeout, timeoutAddr := startReplica(t, 0)
+		timeout.code = DeadlineExceeded
+		_, addr := startReplica(t, 0)
+		xc := NewXClient(NewMultiServerDiscovery([]string{timeoutAddr, addr}), RoundRobinSelect, DefaultOption)
+		defer func() { _ = xc.Close() }()
+		xc.SetHedgePolicy(HedgePolicy{Delay: time.Hour, Methods: policy.Methods})
+		failed := 0
+		for i := 0; i < 2; i++ {
+			if _, err := xc.Call(ctx, "Replica.Read", i, new(int)); err != nil {
+				assert.Equal(t, DeadlineExceeded, ErrorCode(err))
+				failed++
+			}
+		}
+		assert.Equal(t, 1, failed, "a call timed out by server has been handled, so it isn't hedged")
+	})
+	t.Run("cancel dialing", func(t *testing.T) {
+		// silent accepts connections but never answers the handshake
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		defer func() { _ = l.Close() }()
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer func() { _ = conn.Close() }()
+			}
+		}()
+		silent := "tcp@" + l.Addr().String()
+		_, addr := startReplica(t, 0)
+		xc := NewXClient(NewMultiServerDiscovery([]string{silent, addr}), RoundRobinSelect, &Option{ConnectTimeout: 10 * time.Second})
+		defer func() { _ = xc.Close() }()
+		xc.SetHedgePolicy(policy)
+		for i := 0; i < 2; i++ {
+			var reply int
+			_, err := xc.Call(ctx, "Replica.Read", i, &reply)
+			assert.Nil(t, err)
+		}
+		xc.mu.Lock()
+		p := xc.pools[silent]
+		xc.mu.Unlock()
+		dialing := func() int {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return p.dialing
+		}
+		for deadline := time.Now().Add(time.Second); dialing() > 0 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, 0, dialing(), "dialing should be cancelled with the losing attempt")
+	})
+}
@@ -0,0 +1,261 @@
+package xclient
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+	. "yarpc"
+)
+
+// 连接池
+// 默认每个服务实例只缓存一个 Client，所有调用共用一条 TCP 连接。
+// 通过 XClient.SetPool 可以为每个地址维护一组连接：
+// 每次调用选择进行中调用数最少的连接，所有连接的负载都达到 TargetLoad 且连接数小于 MaxConns 时，
+// 新建一条连接；拨号在锁外进行，期间其他调用继续使用已有的连接。
+// 健康检查每隔 HealthCheckInterval 运行一次：移除不可用的连接（断开、收到 GOAWAY 或心跳超时），
+// 仍有调用进行中的不可用连接先移入 draining，最后一个调用结束时再关闭，
+// 关闭空闲超过 IdleTimeout 的多余连接，并把连接数补足到 MinConns。
+
+// PoolOptions configures the connections kept for each server
+type PoolOptions struct {
+	MinConns            int           // connections kept even if they're idle
+	MaxConns            int           // upper bound of connections, 0 means 1
+	TargetLoad          int           // calls in flight on each connection before a new one is dialed, 0 means 16
+	IdleTimeout         time.Duration // close connections beyond MinConns after idle for IdleTimeout, 0 means never
+	HealthCheckInterval time.Duration // how often the pools are checked, 0 disables health checking
+}
+
+const defaultTargetLoad = 16
+
+// SetPool sets how connections are pooled for each server,
+// it should be called before any call is made.
+func (xc *XClient) SetPool(p PoolOptions) {
+	if p.MaxConns <= 0 {
+		p.MaxConns = 1
+	}
+	if p.MinConns > p.MaxConns {
+		p.MinConns = p.MaxConns
+	}
+	if p.TargetLoad <= 0 {
+		p.TargetLoad = defaultTargetLoad
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.poolOpt = p
+	if p.HealthCheckInterval > 0 && xc.stopCheck == nil {
+		xc.stopCheck = make(chan struct{})
+		go xc.healthCheck(p.HealthCheckInterval, xc.stopCheck)
+	}
+}
+
+// healthCheck maintains all pools every interval until stop is closed
+func (xc *XClient) healthCheck(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		xc.mu.Lock()
+		pools := make([]*pool, 0, len(xc.pools))
+		for _, p := range xc.pools {
+			pools = append(pools, p)
+		}
+		xc.mu.Unlock()
+		for _, p := range pools {
+			p.maintain()
+		}
+	}
+}
+
+// pool keeps the clients connected to one server
+type pool struct {
+	rpcAddr string
+	opt     *Option
+	cfg     PoolOptions
+	mu      sync.Mutex // protect following
+	conns   []*pooledConn
+	// draining holds unavailable clients with calls in flight, they're closed once the calls are done
+	draining []*pooledConn
+	dialing  int           // connections being dialed
+	dialed   chan struct{} // closed and replaced when a dial is done
+	closed   bool
+}
+
+// pooledConn is a client in the pool
+type pooledConn struct {
+	client   *Client
+	load     int64 // calls in flight, atomic
+	lastUsed int64 // unix nano of the last call finished, atomic
+}
+
+func newPool(rpcAddr string, opt *Option, cfg PoolOptions) *pool {
+	return &pool{rpcAddr: rpcAddr, opt: opt, cfg: cfg, dialed: make(chan struct{})}
+}
+
+// get returns the least loaded client, a new one is dialed under ctx if all of them are busy,
+// release must be called once the call is done.
+func (p *pool) get(ctx context.Context) (*pooledConn, error) {
+	p.mu.Lock()
+	var best *pooledConn
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrShutdown
+		}
+		p.removeUnavailableLocked()
+		best = nil
+		for _, pc := range p.conns {
+			if best == nil || atomic.LoadInt64(&pc.load) < atomic.LoadInt64(&best.load) {
+				best = pc
+			}
+		}
+		full := len(p.conns)+p.dialing >= p.cfg.MaxConns
+		if best != nil && (atomic.LoadInt64(&best.load) < int64(p.cfg.TargetLoad) || full) {
+			atomic.AddInt64(&best.load, 1)
+			p.mu.Unlock()
+			return best, nil
+		}
+		if !full {
+			break
+		}
+		// no client yet, wait for the ones being dialed
+		dialed := p.dialed
+		p.mu.Unlock()
+		select {
+		case <-dialed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		p.mu.Lock()
+	}
+	p.dialing++
+	p.mu.Unlock()
+
+	pc, err := p.dial(ctx)
+	if err != nil && best != nil {
+		// the busy client is still better than nothing
+		atomic.AddInt64(&best.load, 1)
+		return best, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&pc.load, 1)
+	return pc, nil
+}
+
+// dial adds a new client to the pool, p.dialing must be counted before
+func (p *pool) dial(ctx context.Context) (*pooledConn, error) {
+	client, err := XDialContext(ctx, p.rpcAddr, p.opt)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	close(p.dialed)
+	p.dialed = make(chan struct{})
+	if err != nil {
+		return nil, err
+	}
+	if p.closed {
+		_ = client.Close()
+		return nil, ErrShutdown
+	}
+	pc := &pooledConn{client: client, lastUsed: time.Now().UnixNano()}
+	p.conns = append(p.conns, pc)
+	return pc, nil
+}
+
+// release marks the call on pc done, pc is closed if it's the last call of a draining client
+func (p *pool) release(pc *pooledConn) {
+	atomic.StoreInt64(&pc.lastUsed, time.Now().UnixNano())
+	if atomic.AddInt64(&pc.load, -1) == 0 && !pc.client.IsAvailable() {
+		p.mu.Lock()
+		p.closeDrainedLocked()
+		p.mu.Unlock()
+	}
+}
+
+// removeUnavailableLocked removes broken clients, p.mu must be held.
+// Clients with calls in flight are moved to p.draining, others are closed at once.
+func (p *pool) removeUnavailableLocked() {
+	p.conns = filterConns(p.conns, func(pc *pooledConn) bool {
+		if pc.client.IsAvailable() {
+			return true
+		}
+		// calls sent before GOAWAY are still being answered
+		p.draining = append(p.draining, pc)
+		return false
+	})
+	p.closeDrainedLocked()
+}
+
+// closeDrainedLocked closes draining clients without calls in flight, p.mu must be held
+func (p *pool) closeDrainedLocked() {
+	p.draining = filterConns(p.draining, func(pc *pooledConn) bool {
+		if atomic.LoadInt64(&pc.load) > 0 {
+			return true
+		}
+		_ = pc.client.Close()
+		return false
+	})
+}
+
+// filterConns keeps conns for which keep returns true in place, the tail is cleared for GC
+func filterConns(conns []*pooledConn, keep func(*pooledConn) bool) []*pooledConn {
+	kept := conns[:0]
+	for _, pc := range conns {
+		if keep(pc) {
+			kept = append(kept, pc)
+		}
+	}
+	for i := len(kept); i < len(conns); i++ {
+		conns[i] = nil
+	}
+	return kept
+}
+
+// maintain removes broken and idle clients, and dials clients up to MinConns
+func (p *pool) maintain() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.removeUnavailableLocked()
+	if p.cfg.IdleTimeout > 0 {
+		n := len(p.conns)
+		p.conns = filterConns(p.conns, func(pc *pooledConn) bool {
+			idle := atomic.LoadInt64(&pc.load) == 0 &&
+				time.Since(time.Unix(0, atomic.LoadInt64(&pc.lastUsed))) >= p.cfg.IdleTimeout
+			if idle && n > p.cfg.MinConns {
+				_ = pc.client.Close()
+				n--
+				return false
+			}
+			return true
+		})
+	}
+	missing := p.cfg.MinConns - len(p.conns) - p.dialing
+	if missing < 0 {
+		missing = 0
+	}
+	p.dialing += missing
+	p.mu.Unlock()
+	for i := 0; i < missing; i++ {
+		_, _ = p.dial(context.Background())
+	}
+}
+
+// close closes all clients, calls in flight fail with ErrShutdown
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, pc := range append(p.conns, p.draining...) {
+		_ = pc.client.Close()
+	}
+	p.conns, p.draining = nil, nil
+}
@@ -0,0 +1,121 @@
+package xclient
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	. "yarpc"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type Sleeper int
+
+func (s Sleeper) Sleep(d time.Duration, reply *int) error {
+	time.Sleep(d)
+	return nil
+}
+
+func (p *pool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+func TestXClient_SetPool(t *testing.T) {
+	server := NewServer(0)
+	_ = server.Register(new(Sleeper))
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown(context.Background()) }()
+	rpcAddr := "tcp@" + l.Addr().String()
+
+	xc := NewXClient(NewMultiServerDiscovery([]string{rpcAddr}), RandomSelect, DefaultOption)
+	defer func() { _ = xc.Close() }()
+	xc.SetPool(PoolOptions{MinConns: 1, MaxConns: 3, TargetLoad: 1, IdleTimeout: 50 * time.Millisecond, HealthCheckInterval: 20 * time.Millisecond})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply int
+			_, err := xc.Call(context.Background(), "Sleeper.Sleep", 100*time.Millisecond, &reply)
+			assert.Nil(t, err)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	xc.mu.Lock()
+	p := xc.pools[rpcAddr]
+	xc.mu.Unlock()
+	assert.Equal(t, 3, p.size(), "busy pool should grow up to MaxConns")
+	wg.Wait()
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 1, p.size(), "idle connections beyond MinConns should be closed")
+
+	// broken connections are removed and replaced
+	p.mu.Lock()
+	_ = p.conns[0].client.Close()
+	p.mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, p.size())
+	var reply int
+	_, err := xc.Call(context.Background(), "Sleeper.Sleep", time.Duration(0), &reply)
+	assert.Nil(t, err)
+}
+
+// 不可用但仍有调用进行中的连接在调用结束后关闭
+func TestPool_draining(t *testing.T) {
+	server := NewServer(0)
+	_ = server.Register(new(Sleeper))
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	p := newPool("tcp@"+l.Addr().String(), DefaultOption, PoolOptions{MaxConns: 1, TargetLoad: 1})
+	defer p.close()
+
+	pc, err := p.get(context.Background())
+	assert.Nil(t, err)
+	call := pc.client.Go("Sleeper.Sleep", 200*time.Millisecond, new(int), nil)
+	time.Sleep(20 * time.Millisecond)
+	// GOAWAY arrives while the call is in flight
+	go func() { _ = server.Shutdown(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, pc.client.IsAvailable())
+	p.maintain()
+	p.mu.Lock()
+	assert.Equal(t, 0, len(p.conns))
+	assert.Equal(t, []*pooledConn{pc}, p.draining)
+	p.mu.Unlock()
+
+	<-call.Done
+	assert.Nil(t, call.Error)
+	p.release(pc)
+	p.mu.Lock()
+	assert.Empty(t, p.draining)
+	p.mu.Unlock()
+	assert.Equal(t, ErrShutdown, pc.client.Close(), "client should be closed once its calls are done")
+}
+
+func TestPool_getWaitingCancelled(t *testing.T) {
+	// the listener never accepts, so the handshake of the dial never completes
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	p := newPool("tcp@"+l.Addr().String(), DefaultOption, PoolOptions{MaxConns: 1, TargetLoad: 1})
+	defer p.close()
+
+	dialCtx, cancelDial := context.WithCancel(context.Background())
+	defer cancelDial()
+	go func() { _, _ = p.get(dialCtx) }()
+	time.Sleep(20 * time.Millisecond)
+
+	// the pool is full with the dial, the waiting get ends with its ctx
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := p.get(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
@@ -0,0 +1,166 @@
+package xclient
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+	. "yarpc"
+)
+
+// 重试策略
+// 默认 XClient.Call 只调用 Discovery.Get 选出的一个服务实例，出错直接返回。
+// 通过 XClient.SetRetryPolicy 可以开启重试，只有同时满足以下条件的调用才会重试：
+// 1）方法在 Idempotent 中被标记为幂等，重复执行不会产生副作用；
+// 2）错误码属于 RetryableCodes，默认只有 Unavailable（连接断开、GOAWAY、拨号失败等）；
+// 3）尝试次数未达到 MaxAttempts，调用方的 ctx 也还没有结束；
+// 4）重试预算允许：每次失败消耗一个令牌，每次成功归还 TokenRatio 个，
+// 令牌不超过 MaxTokens 的一半时停止重试，避免服务端故障时重试放大流量（重试风暴）。
+// 每次重试在 Backoff 的等待之后，优先选择还没有尝试过的服务实例，
+// PerAttemptTimeout 限制单次尝试的时间，整体仍受 ctx 的 deadline 约束。
+
+// RetryPolicy configures how XClient.Call retries failed calls
+type RetryPolicy struct {
+	MaxAttempts       int             // attempts including the first one, 0 or 1 means no retry
+	Backoff           Backoff         // delay before each retry
+	RetryableCodes    []Code          // error codes worth retrying, nil means Unavailable only
+	PerAttemptTimeout time.Duration   // timeout of each attempt, 0 means only ctx's deadline applies
+	Idempotent        map[string]bool // "Service.Method" that are safe to call more than once
+	Budget            *RetryBudget    // nil means retries are not throttled
+}
+
+// RetryBudget throttles retries when most calls fail, see RetryPolicy
+type RetryBudget struct {
+	MaxTokens  float64 // tokens at start, retries stop once tokens are not more than MaxTokens/2
+	TokenRatio float64 // tokens given back by each successful call
+
+	mu     sync.Mutex
+	tokens float64
+	inited bool
+}
+
+// SetRetryPolicy sets how failed calls are retried,
+// it should be called before any call is made.
+func (xc *XClient) SetRetryPolicy(p RetryPolicy) {
+	if p.RetryableCodes == nil {
+		p.RetryableCodes = []Code{Unavailable}
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.retry = p
+}
+
+// succeed gives tokens back for a successful call
+func (b *RetryBudget) succeed() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+	if b.tokens += b.TokenRatio; b.tokens > b.MaxTokens {
+		b.tokens = b.MaxTokens
+	}
+}
+
+// fail takes a token for a failure about to be retried, it returns whether the retry is allowed
+func (b *RetryBudget) fail() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+	if b.tokens--; b.tokens < 0 {
+		b.tokens = 0
+	}
+	return b.tokens > b.MaxTokens/2
+}
+
+func (b *RetryBudget) init() {
+	if !b.inited {
+		b.tokens, b.inited = b.MaxTokens, true
+	}
+}
+
+// retryable reports whether the call to serviceMethod failed with err should be retried
+func (p *RetryPolicy) retryable(serviceMethod string, err error) bool {
+	if !p.Idempotent[serviceMethod] {
+		return false
+	}
+	code := ErrorCode(err)
+	for _, c := range p.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// attempt calls rpcAddr once under the per-attempt timeout
+func (xc *XClient) attempt(rpcAddr string, p *RetryPolicy, ctx context.Context, serviceMethod string, args, reply interface{}) (int, error) {
+	if p.PerAttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.PerAttemptTimeout)
+		defer cancel()
+	}
+	return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+}
+
+// callWithRetry calls a server chosen by discovery, and retries on other servers according to the policy
+func (xc *XClient) callWithRetry(ctx context.Context, serviceMethod string, args, reply interface{}) (serverID int, err error) {
+	xc.mu.Lock()
+	p := xc.retry
+	xc.mu.Unlock()
+	rpcAddr, err := xc.d.Get(xc.mode)
+	if err != nil {
+		return 0, err
+	}
+	tried := map[string]bool{}
+	for n := 1; ; n++ {
+		tried[rpcAddr] = true
+		// a timed out attempt may still be decoding its late reply, so each attempt has its own
+		clonedReply := cloneReply(reply)
+		serverID, err = xc.attempt(rpcAddr, &p, ctx, serviceMethod, args, clonedReply)
+		if err == nil {
+			p.Budget.succeed()
+			if reply != nil {
+				setReply(reply, clonedReply)
+			}
+			return serverID, nil
+		}
+		// the budget is only taken when a retry will be made
+		if !p.retryable(serviceMethod, err) || n >= p.MaxAttempts || ctx.Err() != nil || !p.Budget.fail() {
+			return serverID, err
+		}
+		select {
+		case <-time.After(p.Backoff.Delay(n - 1)):
+		case <-ctx.Done():
+			return serverID, err
+		}
+		next, pickErr := xc.pick(tried)
+		if pickErr != nil {
+			// the error of the last attempt tells more than the discovery's
+			return serverID, err
+		}
+		rpcAddr = next
+	}
+}
+
+// pick returns a server not tried yet, any server if all of them have been tried
+func (xc *XClient) pick(tried map[string]bool) (string, error) {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return "", err
+	}
+	var untried []string
+	for _, s := range servers {
+		if !tried[s] {
+			untried = append(untried, s)
+		}
+	}
+	if len(untried) > 0 {
+		return untried[rand.Intn(len(untried))], nil
+	}
+	return xc.d.Get(xc.mode)
+}
@@ -0,0 +1,142 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+	. "yarpc"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Flaky fails with Unavailable if it's down, calls counts the attempts it receives
+type Flaky struct {
+	down  bool
+	calls int64
+}
+
+func (f *Flaky) Get(n int, reply *int) error {
+	atomic.AddInt64(&f.calls, 1)
+	if f.down {
+		return NewError(Unavailable, "flaky is down")
+	}
+	*reply = n
+	return nil
+}
+
+func (f *Flaky) Put(n int, reply *int) error { return f.Get(n, reply) }
+
+func startFlaky(t *testing.T, down bool) (*Flaky, string) {
+	flaky := &Flaky{down: down}
+	server := NewServer(0)
+	_ = server.Register(flaky)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	t.Cleanup(func() { _ = server.Shutdown(context.Background()) })
+	return flaky, "tcp@" + l.Addr().String()
+}
+
+// brokenDiscovery can only pick the server a call starts with
+type brokenDiscovery struct {
+	*MultiServersDiscovery
+}
+
+func (d brokenDiscovery) GetAll() ([]string, error) {
+	return nil, errors.New("registry is down")
+}
+
+func TestXClient_SetRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     Backoff{BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond, Multiplier: 2},
+		Idempotent:  map[string]bool{"Flaky.Get": true},
+	}
+	ctx := context.Background()
+	t.Run("other server", func(t *testing.T) {
+		_, bad := startFlaky(t, true)
+		_, good := startFlaky(t, false)
+		xc := NewXClient(NewMultiServerDiscovery([]string{bad, good}), RoundRobinSelect, DefaultOption)
+		defer func() { _ = xc.Close() }()
+		xc.SetRetryPolicy(policy)
+		for i := 0; i < 10; i++ {
+			var reply int
+			_, err := xc.Call(ctx, "Flaky.Get", i, &reply)
+			assert.Nil(t, err, "failed attempt should be retried on the other server")
+			assert.Equal(t, i, reply)
+		}
+	})
+	t.Run("not idempotent", func(t *testing.T) {
+		flaky, bad := startFlaky(t, true)
+		xc := NewXClient(NewMultiServerDiscovery([]string{bad}), RandomSelect, DefaultOption)
+		defer func() { _ = xc.Close() }()
+		xc.SetRetryPolicy(policy)
+		var reply int
+		_, err := xc.Call(ctx, "Flaky.Put", 1, &reply)
+		assert.Equal(t, Unavailable, ErrorCode(err))
+		assert.Equal(t, int64(1), atomic.LoadInt64(&flaky.calls))
+		_, err = xc.Call(ctx, "Flaky.Get", 1, &reply)
+		assert.Equal(t, Unavailable, ErrorCode(err))
+		assert.Equal(t, int64(1+3), atomic.LoadInt64(&flaky.calls), "idempotent call should be attempted MaxAttempts times")
+	})
+	t.Run("budget", func(t *testing.T) {
+		flaky, bad := startFlaky(t, true)
+		xc := NewXClient(NewMultiServerDiscovery([]string{bad}), RandomSelect, DefaultOption)
+		defer func() { _ = xc.Close() }()
+		p := policy
+		p.MaxAttempts = 5
+		p.Budget = &RetryBudget{MaxTokens: 4, TokenRatio: 0.1}
+		xc.SetRetryPolicy(p)
+		var reply int
+		_, _ = xc.Call(ctx, "Flaky.Get", 1, &reply)
+		assert.Equal(t, int64(2), atomic.LoadInt64(&flaky.calls), "retries should stop at half of the tokens")
+		_, _ = xc.Call(ctx, "Flaky.Get", 1, &reply)
+		assert.Equal(t, int64(3), atomic.LoadInt64(&flaky.calls), "no retry once the budget is used up")
+	})
+	t.Run("budget without retry", func(t *testing.T) {
+		flaky, bad := startFlaky(t, true)
+		xc := NewXClient(NewMultiServerDiscovery([]string{bad}), RandomSelect, DefaultOption)
+		defer func() { _ = xc.Close() }()
+		p := policy
+		p.MaxAttempts = 1
+		p.Budget = &RetryBudget{MaxTokens: 4, TokenRatio: 0.1}
+		xc.SetRetryPolicy(p)
+		var reply int
+		for i := 0; i < 5; i++ {
+			_, _ = xc.Call(ctx, "Flaky.Get", 1, &reply)
+		}
+		// the budget is untouched by failures not retried
+		p.MaxAttempts = 5
+		xc.SetRetryPolicy(p)
+		_, _ = xc.Call(ctx, "Flaky.Get", 1, &reply)
+		assert.Equal(t, int64(5+2), atomic.LoadInt64(&flaky.calls))
+	})
+	t.Run("discovery error", func(t *testing.T) {
+		_, bad := startFlaky(t, true)
+		xc := NewXClient(brokenDiscovery{NewMultiServerDiscovery([]string{bad})}, RandomSelect, DefaultOption)
+		defer func() { _ = xc.Close() }()
+		xc.SetRetryPolicy(policy)
+		reply := -1
+		_, err := xc.Call(ctx, "Flaky.Get", 1, &reply)
+		assert.Equal(t, Unavailable, ErrorCode(err), "the error of the last attempt is returned")
+		assert.Equal(t, -1, reply, "reply is only set by a successful attempt")
+	})
+	t.Run("deadline", func(t *testing.T) {
+		_, bad := startFlaky(t, true)
+		xc := NewXClient(NewMultiServerDiscovery([]string{bad}), RandomSelect, DefaultOption)
+		defer func() { _ = xc.Close() }()
+		p := policy
+		p.MaxAttempts = 100
+		p.Backoff = Backoff{BaseDelay: 50 * time.Millisecond, MaxDelay: 50 * time.Millisecond, Multiplier: 1}
+		xc.SetRetryPolicy(p)
+		ctx, cancel := context.WithTimeout(ctx, 120*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		var reply int
+		_, err := xc.Call(ctx, "Flaky.Get", 1, &reply)
+		assert.Equal(t, Unavailable, ErrorCode(err), "the last error is returned once ctx ends")
+		assert.Less(t, int64(time.Since(start)), int64(200*time.Millisecond))
+	})
+}
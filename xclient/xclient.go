@@ -15,65 +15,66 @@ import (
 
 // XClient is a client support load balance.
 type XClient struct {
-	d       Discovery
-	mode    SelectMode
-	opt     *Option
-	mu      sync.Mutex // protect following
-	clients map[string]*Client
+	d         Discovery
+	mode      SelectMode
+	opt       *Option
+	mu        sync.Mutex // protect following
+	pools     map[string]*pool
+	poolOpt   PoolOptions
+	stopCheck chan struct{} // stops health checking, nil if it's not running
+	retry     RetryPolicy
+	hedge     HedgePolicy
 }
 
 var _ io.Closer = (*XClient)(nil)
 
 // NewXClient return a XClient
+// opt.Interceptors apply to every call sent to each server, including Broadcast
 func NewXClient(d Discovery, mode SelectMode, opt *Option) *XClient {
-	return &XClient{d: d, mode: mode, opt: opt, clients: make(map[string]*Client)}
+	return &XClient{d: d, mode: mode, opt: opt, pools: make(map[string]*pool), poolOpt: PoolOptions{MaxConns: 1, TargetLoad: defaultTargetLoad}}
 }
 
 // XClient close
 func (xc *XClient) Close() error {
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
-	for key, client := range xc.clients {
-		// I have no idea how to deal with error, just ignore it.
-		_ = client.Close()
-		delete(xc.clients, key)
+	for key, p := range xc.pools {
+		p.close()
+		delete(xc.pools, key)
+	}
+	if xc.stopCheck != nil {
+		close(xc.stopCheck)
+		xc.stopCheck = nil
 	}
 	return nil
 }
 
 // 复用Client的能力
-// 1)检查 xc.clients 是否有缓存的 Client，如果有，检查是否是可用状态，
-// 如果是则返回缓存的 Client，如果不可用，则从缓存中删除。
-// 2)如果步骤 1) 没有返回缓存的 Client，则说明需要创建新的 Client，缓存并返回。
-func (xc *XClient) dial(rpcAddr string) (*Client, error) {
+// 每个地址对应一个连接池（见 pool.go），池中不可用的 Client 会被移除，
+// 从池中选择负载最低的 Client，所有 Client 都繁忙且未达到上限时新建一个。
+func (xc *XClient) dial(ctx context.Context, rpcAddr string) (*pool, *pooledConn, error) {
 	xc.mu.Lock()
-	defer xc.mu.Unlock()
-	client, ok := xc.clients[rpcAddr]
-	// cache client but is not availabel
-	if ok && !client.IsAvailable() {
-		_ = client.Close()
-		delete(xc.clients, rpcAddr)
-		client = nil
-	}
-	// no cache client
-	if client == nil {
-		var err error
-		client, err = XDial(rpcAddr, xc.opt)
-		if err != nil {
-			return nil, err
-		}
-		xc.clients[rpcAddr] = client
+	p, ok := xc.pools[rpcAddr]
+	if !ok {
+		p = newPool(rpcAddr, xc.opt, xc.poolOpt)
+		xc.pools[rpcAddr] = p
 	}
-	// cache client & available
-	return client, nil
+	xc.mu.Unlock()
+	pc, err := p.get(ctx)
+	return p, pc, err
 }
 
 func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) (serverID int, err error) {
-	client, err := xc.dial(rpcAddr)
+	p, pc, err := xc.dial(ctx, rpcAddr)
 	if err != nil {
-		return 0, err
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return 0, AsError(ctxErr)
+		}
+		// nothing has been sent, so the call can be retried safely
+		return 0, Errorf(Unavailable, "rpc xclient: dial %s error: %s", rpcAddr, err)
 	}
-	serverID, err = client.Call(ctx, serviceMethod, args, reply)
+	defer p.release(pc)
+	serverID, err = pc.client.Call(ctx, serviceMethod, args, reply)
 	return serverID, err
 }
 
@@ -81,12 +82,26 @@ func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod strin
 // and returns its error status.
 // xc will choose a proper server.
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) (serverID int, err error) {
-	rpcAddr, err := xc.d.Get(xc.mode)
-	if err != nil {
-		return 0, err
+	xc.mu.Lock()
+	hedged := xc.hedge.Methods[serviceMethod]
+	xc.mu.Unlock()
+	if hedged {
+		return xc.callHedged(ctx, serviceMethod, args, reply)
 	}
-	serverID, err = xc.call(rpcAddr, ctx, serviceMethod, args, reply)
-	return serverID, err
+	return xc.callWithRetry(ctx, serviceMethod, args, reply)
+}
+
+// cloneReply returns a new value of reply's type, so that concurrent calls don't write reply at the same time
+func cloneReply(reply interface{}) interface{} {
+	if reply == nil {
+		return nil
+	}
+	return reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+}
+
+// setReply copies the value of clonedReply to reply
+func setReply(reply, clonedReply interface{}) {
+	reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(clonedReply).Elem())
 }
 
 // Broadcast 将请求广播到所有的服务实例，如果任意一个实例发生错误，
@@ -108,15 +123,13 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 	replyDone := reply == nil
 	// check all go routine use this context
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	for _, rpcAddr := range servers {
 		wg.Add(1)
-		go func() {
+		go func(rpcAddr string) {
 			defer wg.Done()
 			// clonedReply to reply to multi request
-			var clonedReply interface{}
-			if reply != nil {
-				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
-			}
+			clonedReply := cloneReply(reply)
 			// it is ok rpcAddr in the for range use only one address,but value will change
 			_, err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
 			mu.Lock()
@@ -126,11 +139,11 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 			}
 			if err == nil && !replyDone {
 				// reply set to clonedReply
-				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(clonedReply).Elem())
+				setReply(reply, clonedReply)
 				replyDone = true
 			}
 			mu.Unlock()
-		}()
+		}(rpcAddr)
 	}
 	wg.Wait()
 	return e
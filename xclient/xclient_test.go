@@ -0,0 +1,63 @@
+package xclient
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	. "yarpc"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Tenant replies the tenant in the request metadata
+type Tenant int
+
+func (Tenant) Get(ctx context.Context, _ int, reply *string) error {
+	md, _ := FromIncomingContext(ctx)
+	*reply = md["tenant"]
+	return nil
+}
+
+func startTenant(t *testing.T) string {
+	server := NewServer(0)
+	_ = server.Register(new(Tenant))
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	t.Cleanup(func() { _ = server.Shutdown(context.Background()) })
+	return "tcp@" + l.Addr().String()
+}
+
+func TestXClient_interceptors(t *testing.T) {
+	servers := []string{startTenant(t), startTenant(t), startTenant(t)}
+	var mu sync.Mutex
+	targets := make(map[*Client]bool) // clients the interceptor has run for
+	var calls int64
+	opt := *DefaultOption
+	opt.Interceptors = []UnaryClientInterceptor{
+		func(ctx context.Context, serviceMethod string, args, reply interface{}, client *Client, invoker UnaryInvoker) error {
+			atomic.AddInt64(&calls, 1)
+			mu.Lock()
+			targets[client] = true
+			mu.Unlock()
+			return invoker(AppendToOutgoingContext(ctx, "tenant", "yarpc"), serviceMethod, args, reply)
+		},
+	}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RoundRobinSelect, &opt)
+	defer func() { _ = xc.Close() }()
+
+	var tenant string
+	_, err := xc.Call(context.Background(), "Tenant.Get", 0, &tenant)
+	assert.Nil(t, err)
+	assert.Equal(t, "yarpc", tenant, "interceptor should run for Call")
+	assert.Equal(t, int64(1), atomic.LoadInt64(&calls))
+
+	tenant = ""
+	assert.Nil(t, xc.Broadcast(context.Background(), "Tenant.Get", 0, &tenant))
+	assert.Equal(t, "yarpc", tenant)
+	assert.Equal(t, int64(1+len(servers)), atomic.LoadInt64(&calls), "interceptor should run for every target of Broadcast")
+	mu.Lock()
+	assert.Equal(t, len(servers), len(targets))
+	mu.Unlock()
+}